@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// error types of the prometheus HTTP API
+const (
+	errorBadData   = "bad_data"
+	errorExecution = "execution"
+	errorTimeout   = "timeout"
+	errorCanceled  = "canceled"
+)
+
+// like prometheus, the most points a range query may return per series
+const apiMaxPoints = 11000
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     model.Value     `json:"result"`
+}
+
+func apiRespond(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&apiResponse{Status: "success", Data: data})
+}
+
+// apiQueryError answers a failed query, as bad_data if it exceeded a
+// -read.* limit.
+func apiQueryError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *queryLimitError:
+		apiError(w, errorBadData, err)
+	case promql.ErrQueryTimeout:
+		apiError(w, errorTimeout, err)
+	case promql.ErrQueryCanceled:
+		apiError(w, errorCanceled, err)
+	default:
+		apiError(w, errorExecution, err)
+	}
+}
+
+func apiError(w http.ResponseWriter, typ string, err error) {
+	code := http.StatusBadRequest
+	switch typ {
+	case errorExecution:
+		code = http.StatusUnprocessableEntity
+	case errorTimeout:
+		code = http.StatusServiceUnavailable
+	case errorCanceled:
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&apiResponse{Status: "error", ErrorType: typ, Error: err.Error()})
+}
+
+// parseTime parses unix seconds with optional decimals or RFC3339.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses seconds with optional decimals or a prometheus
+// duration such as 5m.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(d * float64(time.Second)), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// toMetric converts the labels of a series read from clickhouse.
+func toMetric(labels []*remote.LabelPair) model.Metric {
+	m := make(model.Metric, len(labels))
+	for _, l := range labels {
+		m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return m
+}
+
+// serveQueryRange implements /api/v1/query_range. The aggregations and
+// rate/increase pushdownExpr translates are pushed down to clickhouse, see
+// Pushdown; anything else, or what Pushdown refuses, is evaluated by the
+// prometheus engine.
+func (c *p2cServer) serveQueryRange(tenant string, w http.ResponseWriter, r *http.Request) {
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		apiError(w, errorBadData, fmt.Errorf("invalid parameter 'start': %s", err))
+		return
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		apiError(w, errorBadData, fmt.Errorf("invalid parameter 'end': %s", err))
+		return
+	}
+	if end.Before(start) {
+		apiError(w, errorBadData, fmt.Errorf("end timestamp must not be before start time"))
+		return
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		apiError(w, errorBadData, fmt.Errorf("invalid parameter 'step': %s", err))
+		return
+	}
+	if step < time.Second {
+		apiError(w, errorBadData, fmt.Errorf("zero or negative query resolution step widths are not accepted"))
+		return
+	}
+	if end.Sub(start)/step > apiMaxPoints {
+		apiError(w, errorBadData, fmt.Errorf("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", apiMaxPoints))
+		return
+	}
+	qs := r.FormValue("query")
+	expr, err := promql.ParseExpr(qs)
+	if err != nil {
+		apiError(w, errorBadData, err)
+		return
+	}
+	c.reads.WithLabelValues(tenant).Inc()
+	if e, ok := pushdownExpr(expr); ok {
+		matrix, err := c.reader.Pushdown(r.Context(), tenant, e, start, end, step)
+		switch err {
+		case nil:
+			apiRespond(w, &queryData{ResultType: model.ValMatrix, Result: matrix})
+			return
+		case errNoPushdown:
+			// evaluated by the engine below
+		default:
+			apiQueryError(w, err)
+			return
+		}
+	}
+
+	q, err := c.engine.NewRangeQuery(qs, model.TimeFromUnixNano(start.UnixNano()), model.TimeFromUnixNano(end.UnixNano()), step)
+	if err != nil {
+		apiError(w, errorBadData, err)
+		return
+	}
+	c.execQuery(tenant, w, r, q)
+}
+
+// serveQuery implements /api/v1/query, pushed down or evaluated by the
+// engine like serveQueryRange.
+func (c *p2cServer) serveQuery(tenant string, w http.ResponseWriter, r *http.Request) {
+	ts := time.Now()
+	if t := r.FormValue("time"); t != "" {
+		var err error
+		if ts, err = parseTime(t); err != nil {
+			apiError(w, errorBadData, fmt.Errorf("invalid parameter 'time': %s", err))
+			return
+		}
+	}
+	qs := r.FormValue("query")
+	expr, err := promql.ParseExpr(qs)
+	if err != nil {
+		apiError(w, errorBadData, err)
+		return
+	}
+	c.reads.WithLabelValues(tenant).Inc()
+	if e, ok := pushdownExpr(expr); ok {
+		matrix, err := c.reader.Pushdown(r.Context(), tenant, e, ts, ts, 0)
+		switch err {
+		case nil:
+			vector := make(model.Vector, 0, len(matrix))
+			for _, ss := range matrix {
+				for _, p := range ss.Values {
+					vector = append(vector, &model.Sample{Metric: ss.Metric, Value: p.Value, Timestamp: model.TimeFromUnixNano(ts.UnixNano())})
+				}
+			}
+			apiRespond(w, &queryData{ResultType: model.ValVector, Result: vector})
+			return
+		case errNoPushdown:
+			// evaluated by the engine below
+		default:
+			apiQueryError(w, err)
+			return
+		}
+	}
+
+	q, err := c.engine.NewInstantQuery(qs, model.TimeFromUnixNano(ts.UnixNano()))
+	if err != nil {
+		apiError(w, errorBadData, err)
+		return
+	}
+	c.execQuery(tenant, w, r, q)
+}
+
+// execQuery evaluates q with the engine over the series of tenant and
+// answers with its result.
+func (c *p2cServer) execQuery(tenant string, w http.ResponseWriter, r *http.Request, q promql.Query) {
+	res := q.Exec(context.WithValue(r.Context(), tenantKey{}, tenant))
+	if res.Err != nil {
+		apiQueryError(w, res.Err)
+		return
+	}
+	apiRespond(w, &queryData{ResultType: res.Value.Type(), Result: res.Value})
+}
+
+// parseMetadataParams parses the match[], start and end parameters of the
+// metadata endpoints. Without start only the last day is searched instead
+// of all time like prometheus does, scanning every partition is too slow.
+func parseMetadataParams(r *http.Request) (selectors [][]*remote.LabelMatcher, start, end time.Time, err error) {
+	if err = r.ParseForm(); err != nil {
+		return nil, start, end, err
+	}
+	for _, s := range r.Form["match[]"] {
+		matchers, err := promql.ParseMetricSelector(s)
+		if err != nil {
+			return nil, start, end, fmt.Errorf("invalid parameter 'match[]': %s", err)
+		}
+		selectors = append(selectors, toRemoteMatchers(matchers))
+	}
+
+	end = time.Now()
+	if s := r.FormValue("end"); s != "" {
+		if end, err = parseTime(s); err != nil {
+			return nil, start, end, fmt.Errorf("invalid parameter 'end': %s", err)
+		}
+	}
+	start = end.Add(-24 * time.Hour)
+	if s := r.FormValue("start"); s != "" {
+		if start, err = parseTime(s); err != nil {
+			return nil, start, end, fmt.Errorf("invalid parameter 'start': %s", err)
+		}
+	}
+	return selectors, start, end, nil
+}
+
+// metadataKey identifies a metadata lookup in the cache. Metadata is read
+// per day, so the times are rounded to days.
+func metadataKey(r *http.Request, tenant, name string, start, end time.Time) string {
+	day := int64(24 * time.Hour / time.Second)
+	return fmt.Sprintf("%s\xff%s\xff%s\xff%q\xff%d\xff%d", r.URL.Path, tenant, name, r.Form["match[]"], start.Unix()/day, end.Unix()/day)
+}
+
+// serveLabels implements /api/v1/labels.
+func (c *p2cServer) serveLabels(tenant string, w http.ResponseWriter, r *http.Request) {
+	selectors, start, end, err := parseMetadataParams(r)
+	if err != nil {
+		apiError(w, errorBadData, err)
+		return
+	}
+	names, err := c.metadata.get(metadataKey(r, tenant, "", start, end), func() (interface{}, error) {
+		return c.reader.LabelNames(r.Context(), tenant, selectors, start, end)
+	})
+	if err != nil {
+		apiError(w, errorExecution, err)
+		return
+	}
+	apiRespond(w, names)
+}
+
+// serveLabelValues implements /api/v1/label/<name>/values.
+func (c *p2cServer) serveLabelValues(w http.ResponseWriter, r *http.Request) {
+	// the tenant can only come from the header here
+	tenant, err := c.tenantOf(r, r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !c.allowTenant(permRead, tenant, w, r) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(name, "/values") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/values")
+	if !model.LabelName(name).IsValid() {
+		apiError(w, errorBadData, fmt.Errorf("invalid label name: %q", name))
+		return
+	}
+
+	selectors, start, end, err := parseMetadataParams(r)
+	if err != nil {
+		apiError(w, errorBadData, err)
+		return
+	}
+	values, err := c.metadata.get(metadataKey(r, tenant, name, start, end), func() (interface{}, error) {
+		return c.reader.LabelValues(r.Context(), tenant, name, selectors, start, end)
+	})
+	if err != nil {
+		apiError(w, errorExecution, err)
+		return
+	}
+	apiRespond(w, values)
+}
+
+// serveSeries implements /api/v1/series.
+func (c *p2cServer) serveSeries(tenant string, w http.ResponseWriter, r *http.Request) {
+	selectors, start, end, err := parseMetadataParams(r)
+	if err != nil {
+		apiError(w, errorBadData, err)
+		return
+	}
+	if len(selectors) == 0 {
+		apiError(w, errorBadData, fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+	series, err := c.metadata.get(metadataKey(r, tenant, "", start, end), func() (interface{}, error) {
+		series, err := c.reader.Series(r.Context(), tenant, selectors, start, end)
+		if err != nil {
+			return nil, err
+		}
+		metrics := make([]model.Metric, 0, len(series))
+		for _, labels := range series {
+			metrics = append(metrics, toMetric(labels))
+		}
+		return metrics, nil
+	})
+	if err != nil {
+		apiError(w, errorExecution, err)
+		return
+	}
+	apiRespond(w, series)
+}
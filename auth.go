@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// what a credential may do, admin implies the others
+const (
+	permWrite = "write"
+	permRead  = "read"
+	permAdmin = "admin"
+)
+
+// credential is one entry of the auth file, authenticating either with basic
+// auth or with a bearer token.
+type credential struct {
+	Name     string `yaml:"name"`
+	Username string `yaml:"username"`
+	// PasswordHash is the bcrypt hash of the password, like the
+	// basic_auth_users of the exporter-toolkit web config
+	PasswordHash string   `yaml:"password_hash"`
+	Token        string   `yaml:"token"`
+	Permissions  []string `yaml:"permissions"`
+	// Tenants the credential may read and write, any tenant if empty
+	Tenants []string `yaml:"tenants"`
+}
+
+// credentialKey is the request context key of the authenticated credential.
+type credentialKey struct{}
+
+// credentialOf returns the credential that authenticated r, nil without
+// authentication.
+func credentialOf(r *http.Request) *credential {
+	c, _ := r.Context().Value(credentialKey{}).(*credential)
+	return c
+}
+
+type authFile struct {
+	Credentials []*credential `yaml:"credentials"`
+
+	// verified caches the basic auth passwords that matched, bcrypt is too
+	// slow to run on every remote write
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]*credential
+}
+
+// maxVerified bounds the passwords cached per auth file.
+const maxVerified = 100
+
+// dummyHash is compared with the passwords of unknown users, so the time
+// taken does not tell which usernames exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("prom2click"), bcrypt.DefaultCost)
+
+// authenticator checks the basic auth or bearer token of requests against the
+// credentials of -web.auth-file. The file is re-read on config reloads.
+type authenticator struct {
+	file  string
+	creds atomic.Value // *authFile
+
+	failures *prometheus.CounterVec
+}
+
+func newAuthenticator(file string) (*authenticator, error) {
+	a := &authenticator{
+		file: file,
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_auth_failures_total",
+				Help: "Total number of HTTP requests refused for missing or invalid credentials or permissions, by the permission required.",
+			},
+			[]string{"permission"},
+		),
+	}
+	if err := a.Load(); err != nil {
+		return nil, err
+	}
+	prometheus.MustRegister(a.failures)
+	return a, nil
+}
+
+// Load reads and checks the auth file, the current credentials stay in
+// place if that fails.
+func (a *authenticator) Load() error {
+	f, err := a.read()
+	if err != nil {
+		return err
+	}
+	a.apply(f)
+	return nil
+}
+
+// read reads and checks the auth file without using it.
+func (a *authenticator) read() (*authFile, error) {
+	data, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		return nil, fmt.Errorf("reading auth file: %s", err)
+	}
+	var f authFile
+	if err = yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing auth file %s: %s", a.file, err)
+	}
+
+	usernames := make(map[string]bool)
+	for i, c := range f.Credentials {
+		if c.Name == "" {
+			return nil, fmt.Errorf("auth file %s: credentials[%d]: no name", a.file, i)
+		}
+		switch {
+		case c.Token != "" && c.Username == "":
+		case c.Token == "" && c.Username != "":
+			if usernames[c.Username] {
+				return nil, fmt.Errorf("auth file %s: credential %q: duplicate username %q", a.file, c.Name, c.Username)
+			}
+			usernames[c.Username] = true
+			if c.PasswordHash == "" {
+				return nil, fmt.Errorf("auth file %s: credential %q needs a password_hash", a.file, c.Name)
+			}
+			if _, err = bcrypt.Cost([]byte(c.PasswordHash)); err != nil {
+				return nil, fmt.Errorf("auth file %s: credential %q: invalid password_hash: %s", a.file, c.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("auth file %s: credential %q needs either a username or a token", a.file, c.Name)
+		}
+		for _, p := range c.Permissions {
+			switch p {
+			case permWrite, permRead, permAdmin:
+			default:
+				return nil, fmt.Errorf("auth file %s: credential %q: unknown permission %q", a.file, c.Name, p)
+			}
+		}
+		for _, t := range c.Tenants {
+			if !tenantRE.MatchString(t) {
+				return nil, fmt.Errorf("auth file %s: credential %q: invalid tenant id %q", a.file, c.Name, t)
+			}
+		}
+	}
+
+	return &f, nil
+}
+
+// apply makes the credentials of f, returned by read, the current ones.
+func (a *authenticator) apply(f *authFile) {
+	a.creds.Store(f)
+}
+
+// authenticate returns the credential of the request, or nil.
+func (a *authenticator) authenticate(r *http.Request) *credential {
+	f := a.creds.Load().(*authFile)
+
+	if username, password, ok := r.BasicAuth(); ok {
+		return f.basicAuth(username, password)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+	token := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	var found *credential
+	// compare every token so the time taken does not tell which one matched
+	for _, c := range f.Credentials {
+		if c.Token != "" && subtle.ConstantTimeCompare(token, []byte(c.Token)) == 1 {
+			found = c
+		}
+	}
+	return found
+}
+
+// basicAuth returns the credential of username if password matches its
+// hash, or nil.
+func (f *authFile) basicAuth(username, password string) *credential {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	f.mu.Lock()
+	c, ok := f.verified[key]
+	f.mu.Unlock()
+	if ok {
+		return c
+	}
+
+	hash := dummyHash
+	for _, cred := range f.Credentials {
+		if cred.Username != "" && cred.Username == username {
+			c, hash = cred, []byte(cred.PasswordHash)
+		}
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || c == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.verified == nil {
+		f.verified = make(map[[sha256.Size]byte]*credential)
+	}
+	if len(f.verified) >= maxVerified {
+		for k := range f.verified {
+			delete(f.verified, k)
+			break
+		}
+	}
+	f.verified[key] = c
+	return c
+}
+
+func (c *credential) allowed(perm string) bool {
+	for _, p := range c.Permissions {
+		if p == perm || p == permAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedTenant reports whether the credential may use tenant.
+func (c *credential) allowedTenant(tenant string) bool {
+	if len(c.Tenants) == 0 {
+		return true
+	}
+	for _, t := range c.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// require only passes on requests with a credential having perm, which is
+// added to the request context.
+func (a *authenticator) require(perm string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := a.authenticate(r)
+		if c == nil {
+			a.failures.WithLabelValues(perm).Inc()
+			w.Header().Set("WWW-Authenticate", `Basic realm="prom2click"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !c.allowed(perm) {
+			a.failures.WithLabelValues(perm).Inc()
+			http.Error(w, fmt.Sprintf("%s is not allowed to %s", c.Name, perm), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), credentialKey{}, c)))
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeAuthFile(t *testing.T, dir, yaml string) string {
+	file := filepath.Join(dir, "auth.yml")
+	if err := ioutil.WriteFile(file, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// basic auth passwords are checked against bcrypt hashes, plain and sha256
+// passwords are refused
+func TestAuthBcrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom2click")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{file: writeAuthFile(t, dir, "credentials:\n"+
+		"  - name: grafana\n    username: grafana\n    password_hash: "+string(hash)+"\n    permissions: [read]\n")}
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"grafana", "s3cr3t", true},
+		// cached
+		{"grafana", "s3cr3t", true},
+		{"grafana", "wrong", false},
+		{"other", "s3cr3t", false},
+	} {
+		r := httptest.NewRequest("GET", "/read", nil)
+		r.SetBasicAuth(c.username, c.password)
+		if got := a.authenticate(r); (got != nil) != c.ok {
+			t.Errorf("%s:%s: authenticated %v, want %v", c.username, c.password, got != nil, c.ok)
+		}
+	}
+
+	for _, cred := range []string{
+		"password: s3cr3t",
+		"password_sha256: 2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+		"password_hash: s3cr3t",
+	} {
+		a.file = writeAuthFile(t, dir, "credentials:\n  - name: grafana\n    username: grafana\n    "+cred+"\n")
+		if err := a.Load(); err == nil || !strings.Contains(err.Error(), "password_hash") {
+			t.Errorf("%s: got error %v, want a password_hash error", cred, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Disk is a Store in a leveldb database, so cached values survive restarts.
+// Every value is prefixed with its expiry time, expired values are deleted
+// by Start.
+type Disk struct {
+	db  *leveldb.DB
+	ttl time.Duration
+}
+
+func OpenDisk(path string, ttl time.Duration) (*Disk, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Disk{db: db, ttl: ttl}, nil
+}
+
+func (d *Disk) Get(key string) ([]byte, bool) {
+	v, err := d.db.Get([]byte(key), nil)
+	if err != nil || len(v) < 8 {
+		return nil, false
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(v)) {
+		d.db.Delete([]byte(key), nil)
+		return nil, false
+	}
+	return v[8:], true
+}
+
+func (d *Disk) Set(key string, value []byte) {
+	v := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(v, uint64(time.Now().Add(d.ttl).Unix()))
+	copy(v[8:], value)
+	if err := d.db.Put([]byte(key), v, nil); err != nil {
+		fmt.Printf("Error: writing to the disk cache: %s\n", err)
+	}
+}
+
+// sweep deletes the expired values.
+func (d *Disk) sweep() {
+	now := time.Now().Unix()
+	it := d.db.NewIterator(nil, nil)
+	defer it.Release()
+	batch := new(leveldb.Batch)
+	for it.Next() {
+		if v := it.Value(); len(v) < 8 || now > int64(binary.BigEndian.Uint64(v)) {
+			batch.Delete(append([]byte(nil), it.Key()...))
+		}
+	}
+	if err := it.Error(); err != nil {
+		fmt.Printf("Error: sweeping the disk cache: %s\n", err)
+	}
+	if batch.Len() > 0 {
+		if err := d.db.Write(batch, nil); err != nil {
+			fmt.Printf("Error: sweeping the disk cache: %s\n", err)
+		}
+	}
+}
+
+// Start deletes the expired values every interval.
+func (d *Disk) Start(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			d.sweep()
+		}
+	}()
+}
+
+// Tiered looks values up in the memory store first and then on disk,
+// keeping the values found on disk in memory too.
+type Tiered struct {
+	Memory Store
+	Disk   Store
+}
+
+func (t *Tiered) Get(key string) ([]byte, bool) {
+	if v, ok := t.Memory.Get(key); ok {
+		return v, true
+	}
+	v, ok := t.Disk.Get(key)
+	if ok {
+		t.Memory.Set(key, v)
+	}
+	return v, ok
+}
+
+func (t *Tiered) Set(key string, value []byte) {
+	t.Memory.Set(key, value)
+	t.Disk.Set(key, value)
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Store keeps byte values by key. Values may be dropped at any time.
+type Store interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// LRU is an in-memory Store holding at most MaxBytes of keys and values,
+// evicting the least recently used entries first. Entries expire after TTL.
+type LRU struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	bytes   int64
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+func NewLRU(maxBytes int64, ttl time.Duration) *LRU {
+	return &LRU{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *LRU) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *LRU) Set(key string, value []byte) {
+	size := int64(len(key) + len(value))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: time.Now().Add(c.ttl)})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// Bytes returns the size of the keys and values held.
+func (c *LRU) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+func (c *LRU) remove(el *list.Element) {
+	e := c.order.Remove(el).(*lruEntry)
+	delete(c.entries, e.key)
+	c.bytes -= int64(len(e.key) + len(e.value))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// what to do with series exceeding the cardinality limits
+const (
+	limitReject = "reject"
+	limitDrop   = "drop"
+)
+
+// reasons series are discarded for, used as label of discarded_samples_total
+const (
+	reasonMaxSeries       = "max_series"
+	reasonMaxTenantSeries = "max_tenant_series"
+	reasonMaxLabels       = "max_labels"
+	reasonMaxTracked      = "max_tracked_series"
+)
+
+const (
+	// number of independently locked shards the jobs are spread over
+	cardinalityShards = 16
+	// how often idle series are forgotten
+	cardinalityInterval = time.Minute
+	// number of metrics listed on the debug page
+	cardinalityTopN = 50
+	// key of the series whose job is not in the job config
+	cardinalityUnrouted = "<unrouted>"
+)
+
+// cardinalityKey identifies the series of a job of a tenant, the tenant is
+// empty unless tenants are enabled.
+type cardinalityKey struct {
+	tenant, job string
+}
+
+type cardinalityJob struct {
+	// fingerprint => series
+	series map[uint64]activeSeries
+	// metric name => number of series
+	metrics map[string]int
+	limit   int
+}
+
+type activeSeries struct {
+	name     string
+	lastSeen time.Time
+}
+
+type cardinalityShard struct {
+	mu   sync.Mutex
+	jobs map[cardinalityKey]*cardinalityJob
+}
+
+// cardinalityLimiter tracks the active series of every job by fingerprint
+// and rejects new series once a job or its tenant has its maximum. Series
+// not written to for the idle timeout stop counting. At most maxTracked
+// series are tracked in total, new series beyond are rejected too so the
+// memory stays bounded when series explode.
+type cardinalityLimiter struct {
+	maxLabels       int
+	maxTenantSeries int
+	maxTracked      int64
+	idle            time.Duration
+
+	shards [cardinalityShards]cardinalityShard
+	// tracked is the number of series tracked over all shards
+	tracked int64
+	// tenantsMu guards tenants, it is taken with the lock of a shard held
+	tenantsMu sync.Mutex
+	// tenant => number of tracked series, only with a tenant series limit
+	tenants map[string]int
+
+	active    *prometheus.GaugeVec
+	discarded *prometheus.CounterVec
+}
+
+func newCardinalityLimiter(maxLabels, maxTenantSeries, maxTracked int, idle time.Duration) *cardinalityLimiter {
+	l := &cardinalityLimiter{
+		maxLabels:       maxLabels,
+		maxTenantSeries: maxTenantSeries,
+		maxTracked:      int64(maxTracked),
+		idle:            idle,
+		tenants:         make(map[string]int),
+		active: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "active_series",
+				Help: "Number of series written to recently, by tenant and job.",
+			},
+			[]string{"tenant", "job"},
+		),
+		discarded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "discarded_samples_total",
+				Help: "Total number of received samples discarded for exceeding a cardinality limit, by tenant, job and reason.",
+			},
+			[]string{"tenant", "job", "reason"},
+		),
+	}
+	for i := range l.shards {
+		l.shards[i].jobs = make(map[cardinalityKey]*cardinalityJob)
+	}
+	prometheus.MustRegister(l.active, l.discarded)
+	return l
+}
+
+// shard returns the shard of the series of a job of a tenant, FNV-1a of the
+// key.
+func (l *cardinalityLimiter) shard(key cardinalityKey) *cardinalityShard {
+	h := uint32(2166136261)
+	for _, s := range []string{key.tenant, "\xff", key.job} {
+		for i := 0; i < len(s); i++ {
+			h = (h ^ uint32(s[i])) * 16777619
+		}
+	}
+	return &l.shards[h%cardinalityShards]
+}
+
+// admit checks a series against the limits, tracking it if it is new. It
+// returns the reason the series must be discarded, or "" if it may be
+// written. maxSeries is the series limit of the job, 0 meaning unlimited.
+func (l *cardinalityLimiter) admit(tenant, job string, maxSeries int, name string, fingerprint uint64, nlabels int, now time.Time) string {
+	if l.maxLabels > 0 && nlabels > l.maxLabels {
+		return reasonMaxLabels
+	}
+
+	key := cardinalityKey{tenant: tenant, job: job}
+	sh := l.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	j, ok := sh.jobs[key]
+	if !ok {
+		j = &cardinalityJob{
+			series:  make(map[uint64]activeSeries),
+			metrics: make(map[string]int),
+		}
+		sh.jobs[key] = j
+	}
+	j.limit = maxSeries
+
+	if s, ok := j.series[fingerprint]; ok {
+		s.lastSeen = now
+		j.series[fingerprint] = s
+		return ""
+	}
+	if maxSeries > 0 && len(j.series) >= maxSeries {
+		return reasonMaxSeries
+	}
+	if !l.reserveTracked() {
+		return reasonMaxTracked
+	}
+	if !l.reserveTenant(tenant) {
+		atomic.AddInt64(&l.tracked, -1)
+		return reasonMaxTenantSeries
+	}
+	j.series[fingerprint] = activeSeries{name: name, lastSeen: now}
+	j.metrics[name]++
+	return ""
+}
+
+// reserveTracked counts a new series, unless maxTracked series are tracked
+// already.
+func (l *cardinalityLimiter) reserveTracked() bool {
+	for {
+		n := atomic.LoadInt64(&l.tracked)
+		if n >= l.maxTracked {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.tracked, n, n+1) {
+			return true
+		}
+	}
+}
+
+// reserveTenant counts a new series of tenant, unless the tenant already has
+// its maximum.
+func (l *cardinalityLimiter) reserveTenant(tenant string) bool {
+	if l.maxTenantSeries <= 0 {
+		return true
+	}
+	l.tenantsMu.Lock()
+	defer l.tenantsMu.Unlock()
+	if l.tenants[tenant] >= l.maxTenantSeries {
+		return false
+	}
+	l.tenants[tenant]++
+	return true
+}
+
+func (l *cardinalityLimiter) discard(tenant, job, reason string, samples int) {
+	l.discarded.WithLabelValues(tenant, job, reason).Add(float64(samples))
+}
+
+// expire forgets the series idle for longer than the idle timeout and
+// updates the active series gauges.
+func (l *cardinalityLimiter) expire(now time.Time) {
+	l.active.Reset()
+	for i := range l.shards {
+		l.expireShard(&l.shards[i], now)
+	}
+}
+
+func (l *cardinalityLimiter) expireShard(sh *cardinalityShard, now time.Time) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for key, j := range sh.jobs {
+		expired := 0
+		for fp, s := range j.series {
+			if now.Sub(s.lastSeen) <= l.idle {
+				continue
+			}
+			delete(j.series, fp)
+			if j.metrics[s.name]--; j.metrics[s.name] <= 0 {
+				delete(j.metrics, s.name)
+			}
+			expired++
+		}
+		if expired > 0 {
+			atomic.AddInt64(&l.tracked, -int64(expired))
+			if l.maxTenantSeries > 0 {
+				l.tenantsMu.Lock()
+				if l.tenants[key.tenant] -= expired; l.tenants[key.tenant] <= 0 {
+					delete(l.tenants, key.tenant)
+				}
+				l.tenantsMu.Unlock()
+			}
+		}
+		if len(j.series) == 0 {
+			delete(sh.jobs, key)
+			continue
+		}
+		l.active.WithLabelValues(key.tenant, key.job).Set(float64(len(j.series)))
+	}
+}
+
+// Start expires idle series in the background.
+func (l *cardinalityLimiter) Start() {
+	go func() {
+		for now := range time.Tick(cardinalityInterval) {
+			l.expire(now)
+		}
+	}()
+}
+
+type metricSeries struct {
+	tenant, job, metric string
+	series              int
+}
+
+func (l *cardinalityLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	onlyJob := r.URL.Query().Get("job")
+	onlyTenant := r.URL.Query().Get("tenant")
+
+	type jobSeries struct {
+		cardinalityKey
+		series, limit int
+	}
+	var jobs []jobSeries
+	var metrics []metricSeries
+	for i := range l.shards {
+		sh := &l.shards[i]
+		sh.mu.Lock()
+		for key, j := range sh.jobs {
+			if (onlyJob != "" && key.job != onlyJob) || (onlyTenant != "" && key.tenant != onlyTenant) {
+				continue
+			}
+			jobs = append(jobs, jobSeries{cardinalityKey: key, series: len(j.series), limit: j.limit})
+			for metric, n := range j.metrics {
+				metrics = append(metrics, metricSeries{tenant: key.tenant, job: key.job, metric: metric, series: n})
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].series > jobs[b].series })
+	sort.Slice(metrics, func(a, b int) bool { return metrics[a].series > metrics[b].series })
+	if len(metrics) > cardinalityTopN {
+		metrics = metrics[:cardinalityTopN]
+	}
+
+	fmt.Fprintf(w, "Series written to in the last %s by tenant and job, %d of at most %d tracked:\n\n",
+		l.idle, atomic.LoadInt64(&l.tracked), l.maxTracked)
+	fmt.Fprintf(w, "%-20s %-40s %12s %12s\n", "TENANT", "JOB", "SERIES", "LIMIT")
+	for _, j := range jobs {
+		limit := "-"
+		if j.limit > 0 {
+			limit = fmt.Sprint(j.limit)
+		}
+		fmt.Fprintf(w, "%-20s %-40s %12d %12s\n", j.tenant, j.job, j.series, limit)
+	}
+	fmt.Fprintf(w, "\nTop %d metrics by series:\n\n", len(metrics))
+	fmt.Fprintf(w, "%-20s %-40s %-60s %12s\n", "TENANT", "JOB", "METRIC", "SERIES")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "%-20s %-40s %-60s %12d\n", m.tenant, m.job, m.metric, m.series)
+	}
+}
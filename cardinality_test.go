@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// series are tracked for the top metrics without a series limit, and new
+// series beyond the tracking cap are discarded rather than admitted uncounted
+func TestCardinalityTracking(t *testing.T) {
+	l := newCardinalityLimiter(0, 0, 3, time.Hour)
+	now := time.Now()
+
+	for fp := uint64(1); fp <= 3; fp++ {
+		if reason := l.admit("", "node", 0, "up", fp, 2, now); reason != "" {
+			t.Fatalf("series %d discarded below the cap: %s", fp, reason)
+		}
+	}
+	if reason := l.admit("", "node", 0, "up", 4, 2, now); reason != reasonMaxTracked {
+		t.Errorf("new series at the cap: got reason %q, want %q", reason, reasonMaxTracked)
+	}
+	if reason := l.admit("", "node", 0, "up", 2, 2, now); reason != "" {
+		t.Errorf("tracked series at the cap discarded: %s", reason)
+	}
+
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", "/debug/cardinality", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(body), "3 of at most 3 tracked") {
+		t.Errorf("missing the tracked count:\n%s", body)
+	}
+	found := false
+	for _, line := range strings.Split(string(body), "\n") {
+		if f := strings.Fields(line); len(f) == 3 && f[0] == "node" && f[1] == "up" && f[2] == "3" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("top metrics do not list up of job node with 3 series:\n%s", body)
+	}
+
+	// idle series make room for new ones
+	l.expire(now.Add(2 * time.Hour))
+	if reason := l.admit("", "node", 0, "up", 4, 2, now.Add(2*time.Hour)); reason != "" {
+		t.Errorf("new series discarded after the others expired: %s", reason)
+	}
+}
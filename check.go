@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	cfg "github.com/prom2click/config"
+)
+
+// checkConfig implements the check-config subcommand: it parses and validates
+// the job config, verifies every referenced table in clickhouse and reports
+// the result without starting the server. It returns the process exit code.
+func checkConfig(conf *config) int {
+	checker, err := newSchemaChecker(conf)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return 1
+	}
+
+	config, err := cfg.NewConfigManager(checker.Validate).Read()
+	if err != nil {
+		if verr, ok := err.(*cfg.ValidationError); ok {
+			fmt.Printf("Config is invalid, %d problem(s) found:\n", len(verr.Problems))
+			for _, p := range verr.Problems {
+				fmt.Printf("  - %s\n", p)
+			}
+		} else {
+			fmt.Printf("Error: %s\n", err)
+		}
+		return 1
+	}
+
+	fmt.Printf("Config is valid: %d job(s)\n", len(config.Jobs))
+	for _, j := range config.Jobs {
+		fmt.Printf("  %s => %s.%s\n", j.Name, conf.ChDB, j.Table)
+	}
+	return 0
+}
@@ -1,79 +1,221 @@
 package config
 
 import (
-	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 	"fmt"
 	"sync"
+	"sync/atomic"
+
+	promconfig "github.com/prometheus/prometheus/config"
 )
 
 type Job struct {
 	Name  string
 	Table string
+	// Retention is how long raw samples are kept (eg. 15d), empty keeps
+	// them forever
+	Retention string
+	// RollupRetention is how long the rollup tables are kept (eg. 1y)
+	RollupRetention string
+	// RelabelConfigs are applied in order to every series of the job before
+	// it is written, see Relabel
+	RelabelConfigs []Relabel `mapstructure:"relabel_configs"`
+	// MaxSeries overrides -limits.max-series-per-job for the job
+	MaxSeries int `mapstructure:"max_series"`
 }
 
 type Config struct {
 	Jobs []Job
 }
 
+// Validator is an extra check run against a freshly parsed config before it
+// is accepted, eg. verifying the referenced tables exist in clickhouse.
+type Validator func(cfg *Config) error
+
+// Snapshot is an immutable view of a validated config. A new one is published
+// on every successful reload; nothing reachable from it is ever modified, so
+// it can be used from any goroutine without locking.
+type Snapshot struct {
+	Config  Config
+	jobs    map[string]Job
+	jobmap  map[string]string
+	relabel map[string][]*promconfig.RelabelConfig
+}
+
+// newSnapshot expects a validated config.
+func newSnapshot(config Config) *Snapshot {
+	s := &Snapshot{
+		Config:  config,
+		jobs:    make(map[string]Job, len(config.Jobs)),
+		jobmap:  make(map[string]string, len(config.Jobs)),
+		relabel: make(map[string][]*promconfig.RelabelConfig),
+	}
+	for _, j := range config.Jobs {
+		s.jobs[j.Name] = j
+		s.jobmap[j.Name] = j.Table
+		if cfgs, err := j.CompileRelabels(); err == nil && len(cfgs) > 0 {
+			s.relabel[j.Name] = cfgs
+		}
+	}
+	return s
+}
+
+// Job returns the config of the given job.
+func (s *Snapshot) Job(jobname string) (Job, bool) {
+	j, ok := s.jobs[jobname]
+	return j, ok
+}
+
+// Table returns the table the given job is written to.
+func (s *Snapshot) Table(jobname string) (string, bool) {
+	table, ok := s.jobmap[jobname]
+	return table, ok
+}
+
+// Relabel returns the compiled relabel configs of the given job.
+func (s *Snapshot) Relabel(jobname string) []*promconfig.RelabelConfig {
+	return s.relabel[jobname]
+}
+
+// JobMap returns the job => table mapping. It must not be modified.
+func (s *Snapshot) JobMap() map[string]string {
+	return s.jobmap
+}
+
 type ConfigManager struct {
-	jobmap map[string]string
+	snapshot   atomic.Value // *Snapshot
+	validators []Validator
+
+	// applyMu serializes apply so subscribers see snapshots in order
+	applyMu sync.Mutex
+	// mu guards subs, it is never held while calling a subscriber
 	mu     sync.Mutex
-	config Config
+	subs   map[int]func(*Snapshot)
+	nextID int
 }
 
-func NewConfigManager() *ConfigManager {
+func NewConfigManager(validators ...Validator) *ConfigManager {
 
 	t := &ConfigManager{
-		jobmap: make(map[string]string, 0),
-		config: Config{},
+		validators: validators,
+		subs:       make(map[int]func(*Snapshot)),
 	}
+	t.snapshot.Store(newSnapshot(Config{}))
 	return t
 }
 
+// Snapshot returns the current config.
+func (c *ConfigManager) Snapshot() *Snapshot {
+	return c.snapshot.Load().(*Snapshot)
+}
+
+// GetJobMap returns the job => table mapping of the current config. It must
+// not be modified.
 func (c *ConfigManager) GetJobMap() map[string]string {
-	return c.jobmap
+	return c.Snapshot().JobMap()
 }
 
-func (c *ConfigManager) Load() error {
+// Subscribe registers fn to be called with every snapshot applied from now on,
+// from the goroutine applying it, in the order the subscribers registered.
+// fn may subscribe and unsubscribe: a subscriber added while a snapshot is
+// applied is called from the next one on, one removed may still be called
+// with the snapshot being applied. The returned function unsubscribes.
+func (c *ConfigManager) Subscribe(fn func(*Snapshot)) (unsubscribe func()) {
+	c.mu.Lock()
+	id := c.nextID
+	c.nextID++
+	c.subs[id] = fn
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		delete(c.subs, id)
+		c.mu.Unlock()
+	}
+}
+
+// Read parses the config file and validates it without applying it.
+func (c *ConfigManager) Read() (*Config, error) {
 
 	if c == nil {
-		return fmt.Errorf("null ConfigManager")
+		return nil, fmt.Errorf("null ConfigManager")
 	}
 
 	viper.SetConfigName("config")
 	viper.AddConfigPath("/etc")
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Printf("successful parse the config file : %s\n", viper.ConfigFileUsed())
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("unable to read config file: %v", err)
 	}
+	fmt.Printf("successful parse the config file : %s\n", viper.ConfigFileUsed())
+
+	return c.decode()
+}
+
+// decode unmarshals the config viper currently holds and validates it.
+func (c *ConfigManager) decode() (*Config, error) {
 	var config Config
 	err := viper.Unmarshal(&config)
 	if err != nil {
-		return fmt.Errorf("unable to decode into struct,%v\n", err)
+		return nil, fmt.Errorf("unable to decode into struct, %v", err)
 	}
-	c.mu.Lock()
+	if err = c.validate(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *ConfigManager) validate(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	for _, v := range c.validators {
+		if err := v(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply publishes a config returned by Read as a new snapshot and notifies
+// the subscribers.
+func (c *ConfigManager) Apply(config *Config) {
 	for k, v := range config.Jobs {
 		fmt.Printf("%v,%v,%v\n", k, v.Name, v.Table)
-		c.jobmap[v.Name] = v.Table
 	}
-	c.mu.Unlock()
+	snap := newSnapshot(*config)
 
-	//config xml 有改动，需要重做结构体
-	viper.WatchConfig()
-	viper.OnConfigChange(func(e fsnotify.Event) {
+	c.applyMu.Lock()
+	defer c.applyMu.Unlock()
+	c.snapshot.Store(snap)
 
-		var config Config
-		err := viper.Unmarshal(&config)
-		if err != nil {
-			fmt.Printf("unable to decode into struct,%v\n", err)
-		}
-		c.mu.Lock()
-		for k, v := range config.Jobs {
-			fmt.Printf("%v,%v,%v", k, v.Name, v.Table)
-			c.jobmap[v.Name] = v.Table
+	// the subscribers are called without holding mu, they may (un)subscribe
+	c.mu.Lock()
+	subs := make([]func(*Snapshot), 0, len(c.subs))
+	for id := 0; id < c.nextID; id++ {
+		if fn, ok := c.subs[id]; ok {
+			subs = append(subs, fn)
 		}
-		c.mu.Unlock()
-	})
+	}
+	c.mu.Unlock()
+	for _, fn := range subs {
+		fn(snap)
+	}
+}
+
+func (c *ConfigManager) Load() error {
 
+	config, err := c.Read()
+	if err != nil {
+		return err
+	}
+	c.Apply(config)
 	return nil
 }
+
+// Reload re-reads the config file and swaps it in only if it parses and
+// validates, otherwise the current config stays in place. Reloads are
+// triggered explicitly (SIGHUP, POST /-/reload) rather than by watching the
+// file, so a half-written file is never picked up.
+func (c *ConfigManager) Reload() error {
+	return c.Load()
+}
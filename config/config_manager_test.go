@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// configYAML renders a config with a job per name, writing to table_<name>.
+func configYAML(jobs ...string) string {
+	var b strings.Builder
+	b.WriteString("jobs:\n")
+	for _, j := range jobs {
+		fmt.Fprintf(&b, "  - name: %s\n    table: table_%s\n", j, j)
+		fmt.Fprintf(&b, "    relabel_configs:\n      - action: labeldrop\n        regex: tmp_%s\n", j)
+	}
+	return b.String()
+}
+
+// reload applies yaml the way Reload applies the config file.
+func reload(c *ConfigManager, yaml string) error {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(yaml)); err != nil {
+		return err
+	}
+	cfg, err := c.decode()
+	if err != nil {
+		return err
+	}
+	c.Apply(cfg)
+	return nil
+}
+
+// reloadWithin fails the test if the reload does not return in time, eg.
+// because a subscriber deadlocks it.
+func reloadWithin(t *testing.T, c *ConfigManager, yaml string) {
+	done := make(chan error, 1)
+	go func() {
+		done <- reload(c, yaml)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("reloading: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reload deadlocked applying:\n%s", yaml)
+	}
+}
+
+func TestSnapshotReadsDuringReload(t *testing.T) {
+	c := NewConfigManager()
+	if err := reload(c, configYAML("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				snap := c.Snapshot()
+				for job, table := range snap.JobMap() {
+					if table != "table_"+job {
+						t.Errorf("job %s maps to %s", job, table)
+					}
+					if got, ok := snap.Table(job); !ok || got != table {
+						t.Errorf("Table(%s) = %s, %v; want %s", job, got, ok, table)
+					}
+					if _, ok := snap.Job(job); !ok {
+						t.Errorf("Job(%s) missing from its own snapshot", job)
+					}
+					if len(snap.Relabel(job)) != 1 {
+						t.Errorf("job %s has %d relabel configs, want 1", job, len(snap.Relabel(job)))
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			reloadWithin(t, c, configYAML("a", "c"))
+		} else {
+			reloadWithin(t, c, configYAML("a", "b", "d"))
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// jobWatcher does what the server does with writers: it starts a per-job
+// subscriber for every job a snapshot adds, from within its own subscriber,
+// and the per-job subscribers unsubscribe once their job is removed.
+type jobWatcher struct {
+	c *ConfigManager
+
+	mu      sync.Mutex
+	running map[string]bool
+	tables  map[string]string
+	stopped []string
+}
+
+func (w *jobWatcher) sync(snap *Snapshot) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for job := range snap.JobMap() {
+		if w.running[job] {
+			continue
+		}
+		w.running[job] = true
+		w.tables[job], _ = snap.Table(job)
+		w.startJob(job)
+	}
+}
+
+func (w *jobWatcher) startJob(job string) {
+	var unsubscribe func()
+	var once sync.Once
+	unsubscribe = w.c.Subscribe(func(snap *Snapshot) {
+		table, ok := snap.Table(job)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if !ok {
+			once.Do(func() {
+				delete(w.running, job)
+				delete(w.tables, job)
+				w.stopped = append(w.stopped, job)
+				unsubscribe()
+			})
+			return
+		}
+		w.tables[job] = table
+	})
+}
+
+func TestReloadAddsAndRemovesJobs(t *testing.T) {
+	c := NewConfigManager()
+	w := &jobWatcher{c: c, running: make(map[string]bool), tables: make(map[string]string)}
+	if err := reload(c, configYAML("a")); err != nil {
+		t.Fatal(err)
+	}
+	w.sync(c.Snapshot())
+	c.Subscribe(w.sync)
+
+	reloadWithin(t, c, configYAML("a", "b", "c"))
+	reloadWithin(t, c, configYAML("b", "c"))
+	reloadWithin(t, c, configYAML("a", "c"))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	want := map[string]string{"a": "table_a", "c": "table_c"}
+	if len(w.tables) != len(want) {
+		t.Fatalf("running jobs %v, want %v", w.tables, want)
+	}
+	for job, table := range want {
+		if w.tables[job] != table {
+			t.Errorf("job %s writes to %q, want %q", job, w.tables[job], table)
+		}
+	}
+	if got := strings.Join(w.stopped, ","); got != "a,b" {
+		t.Errorf("stopped jobs %s, want a,b", got)
+	}
+
+	// the unsubscribed jobs no longer hear about reloads
+	c.mu.Lock()
+	subs := len(c.subs)
+	c.mu.Unlock()
+	if subs != 3 {
+		t.Errorf("%d subscribers, want the watcher and 2 jobs", subs)
+	}
+}
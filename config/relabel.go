@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	promconfig "github.com/prometheus/prometheus/config"
+)
+
+// the target_label of a replace action may reference regex groups
+var relabelTargetRE = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+
+// Relabel is one entry of a job's relabel_configs, with the fields and
+// defaults of Prometheus' relabel_config. The optional strings are pointers
+// since an empty separator, regex or replacement is meaningful.
+type Relabel struct {
+	SourceLabels []string `mapstructure:"source_labels"`
+	Separator    *string  `mapstructure:"separator"`
+	Regex        *string  `mapstructure:"regex"`
+	Modulus      uint64   `mapstructure:"modulus"`
+	TargetLabel  string   `mapstructure:"target_label"`
+	Replacement  *string  `mapstructure:"replacement"`
+	Action       string   `mapstructure:"action"`
+}
+
+// Compile converts r into a Prometheus relabel config, checking it the same
+// way Prometheus checks relabel_configs.
+func (r Relabel) Compile() (*promconfig.RelabelConfig, error) {
+	c := promconfig.DefaultRelabelConfig
+	if r.Separator != nil {
+		c.Separator = *r.Separator
+	}
+	if r.Regex != nil {
+		re, err := promconfig.NewRegexp(*r.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", *r.Regex, err)
+		}
+		c.Regex = re
+	}
+	if r.Replacement != nil {
+		c.Replacement = *r.Replacement
+	}
+	c.Modulus = r.Modulus
+	c.TargetLabel = r.TargetLabel
+	for _, l := range r.SourceLabels {
+		if !model.LabelName(l).IsValid() {
+			return nil, fmt.Errorf("invalid source label %q", l)
+		}
+		c.SourceLabels = append(c.SourceLabels, model.LabelName(l))
+	}
+
+	if r.Action != "" {
+		c.Action = promconfig.RelabelAction(strings.ToLower(r.Action))
+	}
+	switch c.Action {
+	case promconfig.RelabelReplace, promconfig.RelabelKeep, promconfig.RelabelDrop, promconfig.RelabelHashMod,
+		promconfig.RelabelLabelMap, promconfig.RelabelLabelDrop, promconfig.RelabelLabelKeep:
+	default:
+		return nil, fmt.Errorf("unknown relabel action %q", r.Action)
+	}
+
+	if c.Modulus == 0 && c.Action == promconfig.RelabelHashMod {
+		return nil, fmt.Errorf("hashmod action requires a non-zero modulus")
+	}
+	if (c.Action == promconfig.RelabelReplace || c.Action == promconfig.RelabelHashMod) && c.TargetLabel == "" {
+		return nil, fmt.Errorf("%s action requires a target_label", c.Action)
+	}
+	if c.Action == promconfig.RelabelReplace && !relabelTargetRE.MatchString(c.TargetLabel) {
+		return nil, fmt.Errorf("%q is an invalid target_label for the %s action", c.TargetLabel, c.Action)
+	}
+	if c.Action == promconfig.RelabelHashMod && !model.LabelName(c.TargetLabel).IsValid() {
+		return nil, fmt.Errorf("%q is an invalid target_label for the %s action", c.TargetLabel, c.Action)
+	}
+	if c.Action == promconfig.RelabelLabelDrop || c.Action == promconfig.RelabelLabelKeep {
+		d := promconfig.DefaultRelabelConfig
+		if r.SourceLabels != nil || c.TargetLabel != d.TargetLabel || c.Modulus != d.Modulus ||
+			c.Separator != d.Separator || c.Replacement != d.Replacement {
+			return nil, fmt.Errorf("%s action requires only a regex", c.Action)
+		}
+	}
+	return &c, nil
+}
+
+// CompileRelabels compiles the relabel configs of the job in order.
+func (j Job) CompileRelabels() ([]*promconfig.RelabelConfig, error) {
+	cfgs := make([]*promconfig.RelabelConfig, 0, len(j.RelabelConfigs))
+	for i, r := range j.RelabelConfigs {
+		c, err := r.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("relabel_configs[%d]: %v", i, err)
+		}
+		cfgs = append(cfgs, c)
+	}
+	return cfgs, nil
+}
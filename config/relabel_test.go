@@ -0,0 +1,418 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	promconfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+func str(s string) *string { return &s }
+
+// The cases of prometheus' relabel_test.go, written as job relabel_configs:
+// fields left out take the defaults of the config file.
+var relabelTests = []struct {
+	input   model.LabelSet
+	relabel []Relabel
+	output  model.LabelSet
+}{
+	{
+		input: model.LabelSet{"a": "foo", "b": "bar", "c": "baz"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("f(.*)"),
+			TargetLabel:  "d",
+			Separator:    str(";"),
+			Replacement:  str("ch${1}-ch${1}"),
+			Action:       "replace",
+		}},
+		output: model.LabelSet{"a": "foo", "b": "bar", "c": "baz", "d": "choo-choo"},
+	},
+	{
+		input: model.LabelSet{"a": "foo", "b": "bar", "c": "baz"},
+		relabel: []Relabel{
+			{
+				SourceLabels: []string{"a", "b"},
+				Regex:        str("f(.*);(.*)r"),
+				TargetLabel:  "a",
+				Separator:    str(";"),
+				Replacement:  str("b${1}${2}m"), // boobam
+				Action:       "replace",
+			},
+			{
+				SourceLabels: []string{"c", "a"},
+				Regex:        str("(b).*b(.*)ba(.*)"),
+				TargetLabel:  "d",
+				Separator:    str(";"),
+				Replacement:  str("$1$2$2$3"),
+				Action:       "replace",
+			},
+		},
+		output: model.LabelSet{"a": "boobam", "b": "bar", "c": "baz", "d": "boooom"},
+	},
+	{
+		input: model.LabelSet{"a": "foo"},
+		relabel: []Relabel{
+			{
+				SourceLabels: []string{"a"},
+				Regex:        str(".*o.*"),
+				Action:       "drop",
+			}, {
+				SourceLabels: []string{"a"},
+				Regex:        str("f(.*)"),
+				TargetLabel:  "d",
+				Separator:    str(";"),
+				Replacement:  str("ch$1-ch$1"),
+				Action:       "replace",
+			},
+		},
+		output: nil,
+	},
+	{
+		input: model.LabelSet{"a": "foo", "b": "bar"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str(".*o.*"),
+			Action:       "drop",
+		}},
+		output: nil,
+	},
+	{
+		input: model.LabelSet{"a": "abc"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str(".*(b).*"),
+			TargetLabel:  "d",
+			Separator:    str(";"),
+			Replacement:  str("$1"),
+			Action:       "replace",
+		}},
+		output: model.LabelSet{"a": "abc", "d": "b"},
+	},
+	{
+		input: model.LabelSet{"a": "foo"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("no-match"),
+			Action:       "drop",
+		}},
+		output: model.LabelSet{"a": "foo"},
+	},
+	{
+		input: model.LabelSet{"a": "foo"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("f|o"),
+			Action:       "drop",
+		}},
+		output: model.LabelSet{"a": "foo"},
+	},
+	{
+		input: model.LabelSet{"a": "foo"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("no-match"),
+			Action:       "keep",
+		}},
+		output: nil,
+	},
+	{
+		input: model.LabelSet{"a": "foo"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("f.*"),
+			Action:       "keep",
+		}},
+		output: model.LabelSet{"a": "foo"},
+	},
+	{
+		// No replacement must be applied if there is no match.
+		input: model.LabelSet{"a": "boo"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("f"),
+			TargetLabel:  "b",
+			Replacement:  str("bar"),
+			Action:       "replace",
+		}},
+		output: model.LabelSet{"a": "boo"},
+	},
+	{
+		input: model.LabelSet{"a": "foo", "b": "bar", "c": "baz"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"c"},
+			TargetLabel:  "d",
+			Separator:    str(";"),
+			Action:       "hashmod",
+			Modulus:      1000,
+		}},
+		output: model.LabelSet{"a": "foo", "b": "bar", "c": "baz", "d": "976"},
+	},
+	{
+		input: model.LabelSet{"a": "foo", "b1": "bar", "b2": "baz"},
+		relabel: []Relabel{{
+			Regex:       str("(b.*)"),
+			Replacement: str("bar_${1}"),
+			Action:      "labelmap",
+		}},
+		output: model.LabelSet{"a": "foo", "b1": "bar", "b2": "baz", "bar_b1": "bar", "bar_b2": "baz"},
+	},
+	{
+		input: model.LabelSet{"a": "foo", "__meta_my_bar": "aaa", "__meta_my_baz": "bbb", "__meta_other": "ccc"},
+		relabel: []Relabel{{
+			Regex:       str("__meta_(my.*)"),
+			Replacement: str("${1}"),
+			Action:      "labelmap",
+		}},
+		output: model.LabelSet{
+			"a": "foo", "__meta_my_bar": "aaa", "__meta_my_baz": "bbb", "__meta_other": "ccc",
+			"my_bar": "aaa", "my_baz": "bbb",
+		},
+	},
+	{ // valid case
+		input: model.LabelSet{"a": "some-name-value"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("some-([^-]+)-([^,]+)"),
+			Action:       "replace",
+			Replacement:  str("${2}"),
+			TargetLabel:  "${1}",
+		}},
+		output: model.LabelSet{"a": "some-name-value", "name": "value"},
+	},
+	{ // invalid replacement ""
+		input: model.LabelSet{"a": "some-name-value"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("some-([^-]+)-([^,]+)"),
+			Action:       "replace",
+			Replacement:  str("${3}"),
+			TargetLabel:  "${1}",
+		}},
+		output: model.LabelSet{"a": "some-name-value"},
+	},
+	{ // invalid target_labels, "0${3}" and "-${3}" are rejected by Compile
+		input: model.LabelSet{"a": "some-name-value"},
+		relabel: []Relabel{{
+			SourceLabels: []string{"a"},
+			Regex:        str("some-([^-]+)-([^,]+)"),
+			Action:       "replace",
+			Replacement:  str("${1}"),
+			TargetLabel:  "${3}",
+		}},
+		output: model.LabelSet{"a": "some-name-value"},
+	},
+	{ // more complex real-life like usecase
+		input: model.LabelSet{"__meta_sd_tags": "path:/secret,job:some-job,label:foo=bar"},
+		relabel: []Relabel{
+			{
+				SourceLabels: []string{"__meta_sd_tags"},
+				Regex:        str("(?:.+,|^)path:(/[^,]+).*"),
+				Action:       "replace",
+				Replacement:  str("${1}"),
+				TargetLabel:  "__metrics_path__",
+			},
+			{
+				SourceLabels: []string{"__meta_sd_tags"},
+				Regex:        str("(?:.+,|^)job:([^,]+).*"),
+				Action:       "replace",
+				Replacement:  str("${1}"),
+				TargetLabel:  "job",
+			},
+			{
+				SourceLabels: []string{"__meta_sd_tags"},
+				Regex:        str("(?:.+,|^)label:([^=]+)=([^,]+).*"),
+				Action:       "replace",
+				Replacement:  str("${2}"),
+				TargetLabel:  "${1}",
+			},
+		},
+		output: model.LabelSet{
+			"__meta_sd_tags":   "path:/secret,job:some-job,label:foo=bar",
+			"__metrics_path__": "/secret",
+			"job":              "some-job",
+			"foo":              "bar",
+		},
+	},
+	{
+		input: model.LabelSet{"a": "foo", "b1": "bar", "b2": "baz"},
+		relabel: []Relabel{{
+			Regex:  str("(b.*)"),
+			Action: "labelkeep",
+		}},
+		output: model.LabelSet{"b1": "bar", "b2": "baz"},
+	},
+	{
+		input: model.LabelSet{"a": "foo", "b1": "bar", "b2": "baz"},
+		relabel: []Relabel{{
+			Regex:  str("(b.*)"),
+			Action: "labeldrop",
+		}},
+		output: model.LabelSet{"a": "foo"},
+	},
+}
+
+func TestRelabel(t *testing.T) {
+	for i, test := range relabelTests {
+		cfgs, err := Job{RelabelConfigs: test.relabel}.CompileRelabels()
+		if err != nil {
+			t.Errorf("Test %d: %v", i+1, err)
+			continue
+		}
+		res := relabel.Process(test.input.Clone(), cfgs...)
+		if !reflect.DeepEqual(res, test.output) {
+			t.Errorf("Test %d: relabel output mismatch: expected %#v, got %#v", i+1, test.output, res)
+		}
+	}
+}
+
+// The relabel_configs prometheus' config_test.go expects to be rejected, plus
+// the target labels Process would otherwise ignore. The cases with an empty
+// errMsg compile.
+var relabelCompileTests = []struct {
+	name    string
+	relabel Relabel
+	errMsg  string
+}{
+	{"regex.bad", Relabel{Regex: str("abc(def")}, "invalid regex"},
+	{"modulus_missing.bad", Relabel{Regex: str("abcdef"), Action: "hashmod"}, "requires a non-zero modulus"},
+	{"labelkeep.bad", Relabel{SourceLabels: []string{"abcdef"}, Action: "labelkeep"}, "labelkeep action requires only a regex"},
+	{"labelkeep2.bad", Relabel{Modulus: 8, Action: "labelkeep"}, "labelkeep action requires only a regex"},
+	{"labelkeep3.bad", Relabel{Separator: str(","), Action: "labelkeep"}, "labelkeep action requires only a regex"},
+	{"labelkeep4.bad", Relabel{Replacement: str("yolo-{1}"), Action: "labelkeep"}, "labelkeep action requires only a regex"},
+	{"labelkeep5.bad", Relabel{TargetLabel: "yolo", Action: "labelkeep"}, "labelkeep action requires only a regex"},
+	{"labeldrop.bad", Relabel{SourceLabels: []string{"abcdef"}, Action: "labeldrop"}, "labeldrop action requires only a regex"},
+	{"labeldrop2.bad", Relabel{Modulus: 8, Action: "labeldrop"}, "labeldrop action requires only a regex"},
+	{"labeldrop3.bad", Relabel{Separator: str(","), Action: "labeldrop"}, "labeldrop action requires only a regex"},
+	{"labeldrop4.bad", Relabel{Replacement: str("yolo-{1}"), Action: "labeldrop"}, "labeldrop action requires only a regex"},
+	{"labeldrop5.bad", Relabel{TargetLabel: "yolo", Action: "labeldrop"}, "labeldrop action requires only a regex"},
+	{"target_label_missing.bad", Relabel{Regex: str("abcdef")}, "replace action requires a target_label"},
+	{"target_label_hashmod_missing.bad", Relabel{SourceLabels: []string{"__address__"}, Modulus: 8, Action: "hashmod"}, "hashmod action requires a target_label"},
+	{"source label", Relabel{SourceLabels: []string{"not$allowed"}, TargetLabel: "a"}, "invalid source label"},
+	{"target label digit", Relabel{TargetLabel: "0${3}"}, "invalid target_label"},
+	{"target label dash", Relabel{TargetLabel: "-${3}"}, "invalid target_label"},
+	{"hashmod target label", Relabel{TargetLabel: "${1}", Modulus: 8, Action: "hashmod"}, "invalid target_label"},
+	{"unknown action", Relabel{Action: "nope"}, "unknown relabel action"},
+	{"labeldrop default separator", Relabel{Separator: str(";"), Replacement: str("$1"), Action: "labeldrop"}, ""},
+}
+
+func TestRelabelCompile(t *testing.T) {
+	for _, test := range relabelCompileTests {
+		_, err := test.relabel.Compile()
+		if test.errMsg == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf("%s: expected error to contain %q, got: %s", test.name, test.errMsg, err)
+		}
+	}
+}
+
+// The relabel_configs of a job config file decode into Relabel, with the
+// fields left out taking their defaults.
+func TestRelabelDecode(t *testing.T) {
+	yaml := `
+jobs:
+  - name: node
+    table: node
+    relabel_configs:
+      - source_labels: [a, b]
+        separator: ""
+        target_label: c
+      - regex: tmp_.*
+        action: LabelDrop
+`
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewConfigManager().decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs, err := cfg.Jobs[0].CompileRelabels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := relabel.Process(model.LabelSet{"a": "x", "b": "y", "tmp_z": "z"}, cfgs...)
+	want := model.LabelSet{"a": "x", "b": "y", "c": "xy"}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("relabel output mismatch: expected %#v, got %#v", want, res)
+	}
+}
+
+// promRelabel parses r the way prometheus parses a relabel_config.
+func promRelabel(r Relabel) (*promconfig.RelabelConfig, error) {
+	m := make(map[string]interface{})
+	if r.SourceLabels != nil {
+		m["source_labels"] = r.SourceLabels
+	}
+	if r.Separator != nil {
+		m["separator"] = *r.Separator
+	}
+	if r.Regex != nil {
+		m["regex"] = *r.Regex
+	}
+	if r.Modulus != 0 {
+		m["modulus"] = r.Modulus
+	}
+	if r.TargetLabel != "" {
+		m["target_label"] = r.TargetLabel
+	}
+	if r.Replacement != nil {
+		m["replacement"] = *r.Replacement
+	}
+	if r.Action != "" {
+		m["action"] = r.Action
+	}
+	out, err := yaml.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var c promconfig.RelabelConfig
+	if err := yaml.Unmarshal(out, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Compile accepts and rejects the same relabel_configs as prometheus and
+// compiles them to the same config.
+func TestRelabelCompileMatchesPrometheus(t *testing.T) {
+	var all []Relabel
+	for _, test := range relabelTests {
+		all = append(all, test.relabel...)
+	}
+	for _, test := range relabelCompileTests {
+		all = append(all, test.relabel)
+	}
+	for i, r := range all {
+		got, err := r.Compile()
+		want, perr := promRelabel(r)
+		if (err == nil) != (perr == nil) {
+			t.Errorf("relabel %d %+v: Compile error %v, prometheus error %v", i, r, err, perr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(got.SourceLabels, want.SourceLabels) || got.Separator != want.Separator ||
+			got.Regex.String() != want.Regex.String() || got.Modulus != want.Modulus ||
+			got.TargetLabel != want.TargetLabel || got.Replacement != want.Replacement || got.Action != want.Action {
+			t.Errorf("relabel %d: compiled to %+v, prometheus to %+v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// clickhouse identifiers we are willing to interpolate into SQL unquoted
+var identifierRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidationError collects every problem found in a config so they can all
+// be reported at once instead of one per run.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the config for mistakes that would otherwise silently
+// drop data: empty or duplicate job names, missing or malformed tables,
+// invalid relabel configs and invalid or conflicting retentions.
+func (c *Config) Validate() error {
+	verr := &ValidationError{}
+
+	if len(c.Jobs) == 0 {
+		verr.add("no jobs configured")
+	}
+
+	type retention struct {
+		job         string
+		raw, rollup time.Duration
+	}
+	retentions := make(map[string]retention)
+	seen := make(map[string]int, len(c.Jobs))
+	for i, j := range c.Jobs {
+		if j.Name == "" {
+			verr.add("jobs[%d]: empty job name", i)
+		} else if first, ok := seen[j.Name]; ok {
+			verr.add("jobs[%d]: duplicate job %q (first defined at jobs[%d])", i, j.Name, first)
+		} else {
+			seen[j.Name] = i
+		}
+
+		if j.Table == "" {
+			verr.add("jobs[%d]: job %q has no table", i, j.Name)
+		} else if !identifierRE.MatchString(j.Table) {
+			verr.add("jobs[%d]: job %q has invalid table name %q", i, j.Name, j.Table)
+		}
+
+		if j.MaxSeries < 0 {
+			verr.add("jobs[%d]: job %q has a negative max_series", i, j.Name)
+		}
+
+		if _, err := j.CompileRelabels(); err != nil {
+			verr.add("jobs[%d]: job %q: %v", i, j.Name, err)
+		}
+
+		raw, rollup, err := j.Retentions()
+		if err != nil {
+			verr.add("jobs[%d]: job %q: %v", i, j.Name, err)
+			continue
+		}
+		// retention is applied per table, so jobs sharing one must agree
+		if other, ok := retentions[j.Table]; ok && (other.raw != raw || other.rollup != rollup) {
+			verr.add("jobs[%d]: job %q has a different retention than job %q sharing table %q", i, j.Name, other.job, j.Table)
+		} else if !ok {
+			retentions[j.Table] = retention{job: j.Name, raw: raw, rollup: rollup}
+		}
+	}
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// Retentions returns the parsed retention of raw samples and rollups, zero
+// meaning forever.
+func (j Job) Retentions() (raw, rollup time.Duration, err error) {
+	parse := func(name, s string) (time.Duration, error) {
+		if s == "" {
+			return 0, nil
+		}
+		d, err := model.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q: %v", name, s, err)
+		}
+		if time.Duration(d) < 24*time.Hour {
+			return 0, fmt.Errorf("invalid %s %q: must be at least 1d", name, s)
+		}
+		return time.Duration(d), nil
+	}
+	if raw, err = parse("retention", j.Retention); err != nil {
+		return
+	}
+	rollup, err = parse("rollupretention", j.RollupRetention)
+	return
+}
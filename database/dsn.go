@@ -0,0 +1,190 @@
+package database
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "xxxxx"
+
+// Credential is a single DSN component. It is taken from File if set (eg. a
+// mounted kubernetes secret), then from Value, then from the Env environment
+// variable. If none is set the component of the base DSN is kept.
+type Credential struct {
+	Value string
+	Env   string
+	File  string
+}
+
+func (c Credential) resolve() (string, bool, error) {
+	if c.File != "" {
+		b, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return "", false, err
+		}
+		return strings.TrimSpace(string(b)), true, nil
+	}
+	if c.Value != "" {
+		return c.Value, true, nil
+	}
+	if c.Env != "" {
+		if v, ok := os.LookupEnv(c.Env); ok {
+			return v, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// DSN builds the clickhouse DSN from a base DSN with the host and credentials
+// overridden separately, so the password never has to be passed on the
+// command line.
+type DSN struct {
+	Base     string
+	Host     Credential
+	Username Credential
+	Password Credential
+	// TLS connects with the secure protocol, verifying the server certificate
+	// unless SkipVerify is set
+	TLS        bool
+	SkipVerify bool
+	// TLSConfig is the name of a tls config registered with the driver's
+	// RegisterTLSConfig, for the CAs and client certificate
+	TLSConfig string
+
+	mu      sync.Mutex
+	current string
+	subs    map[int]func(dsn string)
+	nextID  int
+}
+
+// build resolves every component and returns the resulting DSN.
+func (d *DSN) build() (string, error) {
+	u, err := url.Parse(d.Base)
+	if err != nil {
+		return "", fmt.Errorf("invalid clickhouse dsn %s: %v", Redact(d.Base), err)
+	}
+	q := u.Query()
+	if host, ok, err := d.Host.resolve(); err != nil {
+		return "", fmt.Errorf("reading clickhouse host: %v", err)
+	} else if ok {
+		u.Host = host
+	}
+	if user, ok, err := d.Username.resolve(); err != nil {
+		return "", fmt.Errorf("reading clickhouse username: %v", err)
+	} else if ok {
+		q.Set("username", user)
+	}
+	if pass, ok, err := d.Password.resolve(); err != nil {
+		return "", fmt.Errorf("reading clickhouse password: %v", err)
+	} else if ok {
+		q.Set("password", pass)
+	}
+	if d.TLS {
+		q.Set("secure", "true")
+		// skip_verify overrides the InsecureSkipVerify of the tls config
+		q.Set("skip_verify", strconv.FormatBool(d.SkipVerify))
+		if d.TLSConfig != "" {
+			q.Set("tls_config", d.TLSConfig)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Load resolves the DSN for the first time.
+func (d *DSN) Load() error {
+	dsn, err := d.build()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.current = dsn
+	d.mu.Unlock()
+	return nil
+}
+
+// Get returns the current DSN, including credentials. Never print it, use
+// String instead.
+func (d *DSN) Get() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// String returns the current DSN with the password redacted.
+func (d *DSN) String() string {
+	return Redact(d.Get())
+}
+
+// Subscribe registers fn to be called with the new DSN whenever the
+// credentials change. The returned function unsubscribes.
+func (d *DSN) Subscribe(fn func(dsn string)) (unsubscribe func()) {
+	d.mu.Lock()
+	if d.subs == nil {
+		d.subs = make(map[int]func(dsn string))
+	}
+	id := d.nextID
+	d.nextID++
+	d.subs[id] = fn
+	d.mu.Unlock()
+
+	return func() {
+		d.mu.Lock()
+		delete(d.subs, id)
+		d.mu.Unlock()
+	}
+}
+
+// Watch re-resolves the DSN every interval so rotated secret files are picked
+// up without a restart. It never returns.
+func (d *DSN) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		dsn, err := d.build()
+		if err != nil {
+			fmt.Printf("Error: refreshing clickhouse credentials: %s\n", err)
+			continue
+		}
+		d.mu.Lock()
+		if dsn == d.current {
+			d.mu.Unlock()
+			continue
+		}
+		d.current = dsn
+		subs := make([]func(dsn string), 0, len(d.subs))
+		for id := 0; id < d.nextID; id++ {
+			if fn, ok := d.subs[id]; ok {
+				subs = append(subs, fn)
+			}
+		}
+		d.mu.Unlock()
+
+		fmt.Printf("clickhouse credentials changed, reconnecting to %s\n", Redact(dsn))
+		for _, fn := range subs {
+			fn(dsn)
+		}
+	}
+}
+
+// Redact hides the password in a clickhouse DSN, both as query parameter and
+// as url userinfo.
+func Redact(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	q := u.Query()
+	if q.Get("password") != "" {
+		q.Set("password", redacted)
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
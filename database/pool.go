@@ -0,0 +1,88 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Pool is a clickhouse connection pool that transparently reconnects when the
+// DSN credentials change.
+type Pool struct {
+	db      atomic.Value // *sql.DB
+	maxOpen int
+	maxIdle int
+
+	// mu serializes reopen and Close, a closed pool is never reopened
+	mu          sync.Mutex
+	closed      bool
+	unsubscribe func()
+}
+
+// Open connects to clickhouse and follows credential changes of dsn until
+// the pool is closed.
+func Open(dsn *DSN, maxOpen, maxIdle int) (*Pool, error) {
+	p := &Pool{maxOpen: maxOpen, maxIdle: maxIdle}
+	db, err := p.open(dsn.Get())
+	if err != nil {
+		return nil, err
+	}
+	p.db.Store(db)
+	p.unsubscribe = dsn.Subscribe(p.reopen)
+	return p, nil
+}
+
+// FromDB wraps a connection pool opened elsewhere, eg. with another driver
+// in tests. It does not follow any DSN.
+func FromDB(db *sql.DB) *Pool {
+	p := &Pool{unsubscribe: func() {}}
+	p.db.Store(db)
+	return p
+}
+
+func (p *Pool) open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("clickhouse", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(p.maxOpen)
+	db.SetMaxIdleConns(p.maxIdle)
+	db.Ping()
+	return db, nil
+}
+
+func (p *Pool) reopen(dsn string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	db, err := p.open(dsn)
+	if err != nil {
+		fmt.Printf("Error connecting to clickhouse: %s\n", err.Error())
+		return
+	}
+	old := p.db.Load().(*sql.DB)
+	p.db.Store(db)
+	// Close waits for queries already running on the old pool
+	go old.Close()
+}
+
+// Close stops following the DSN and closes the connections.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	p.unsubscribe()
+	return p.DB().Close()
+}
+
+// DB returns the current connection pool. Callers should not hold on to it
+// across requests so they pick up reconnects.
+func (p *Pool) DB() *sql.DB {
+	return p.db.Load().(*sql.DB)
+}
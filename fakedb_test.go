@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	cfg "github.com/prom2click/config"
+	"github.com/prom2click/database"
+	"github.com/prom2click/job"
+)
+
+// fakeHandler answers a query of the fake driver with the names of the
+// columns and the rows, which hold the values the clickhouse driver scans
+// into, eg. []string for an Array(String) column.
+type fakeHandler func(query string) (columns []string, rows [][]driver.Value, err error)
+
+// fakeDriver is a database/sql driver answering every query of a connection
+// with the handler registered for its DSN, to drive the readers without
+// clickhouse.
+type fakeDriver struct{}
+
+// fakeHandlers holds the handler of each DSN.
+var fakeHandlers sync.Map
+
+// fakeDSNs numbers the DSNs, a connection keeps the handler it was opened
+// with.
+var fakeDSNs int64
+
+func init() {
+	sql.Register("fakeclickhouse", fakeDriver{})
+}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	h, ok := fakeHandlers.Load(dsn)
+	if !ok {
+		return nil, errors.New("fakeclickhouse: no handler for " + dsn)
+	}
+	return fakeConn{handler: h.(fakeHandler)}, nil
+}
+
+type fakeConn struct {
+	handler fakeHandler
+}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakeclickhouse: statements are not supported")
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakeclickhouse: transactions are not supported")
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	columns, rows, err := c.handler(query)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// fakeReader returns a reader of the wide layout table metrics.samples
+// whose queries handler answers.
+func fakeReader(t *testing.T, handler fakeHandler) *p2cReader {
+	dsn := fmt.Sprintf("%s/%d", t.Name(), atomic.AddInt64(&fakeDSNs, 1))
+	fakeHandlers.Store(dsn, handler)
+	db, err := sql.Open("fakeclickhouse", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &p2cReader{
+		conf: &config{
+			ChDB:         "metrics",
+			ChTable:      "samples",
+			CHQuantile:   0.75,
+			CHMaxSamples: 11000,
+			CHMinPeriod:  10,
+		},
+		db: database.FromDB(db),
+		jm: job.NewJobManagerOf(0, cfg.NewConfigManager()),
+	}
+}
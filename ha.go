@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+type haCluster struct {
+	tenant, name string
+}
+
+type haReplica struct {
+	name     string
+	lastSeen time.Time
+}
+
+// haTracker deduplicates the samples of Prometheus HA pairs: per tenant and
+// value of the cluster label only the samples of one elected replica are
+// accepted.
+// When the elected replica has not sent anything for the failover timeout,
+// the next replica to send is elected instead.
+type haTracker struct {
+	clusterLabel string
+	replicaLabel string
+	timeout      time.Duration
+
+	mu      sync.Mutex
+	elected map[haCluster]*haReplica
+
+	deduped  *prometheus.CounterVec
+	failover *prometheus.CounterVec
+}
+
+func newHATracker(clusterLabel, replicaLabel string, timeout time.Duration) *haTracker {
+	t := &haTracker{
+		clusterLabel: clusterLabel,
+		replicaLabel: replicaLabel,
+		timeout:      timeout,
+		elected:      make(map[haCluster]*haReplica),
+		deduped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ha_deduplicated_samples_total",
+				Help: "Total number of samples dropped because they came from a non-elected HA replica.",
+			},
+			[]string{"tenant", "cluster"},
+		),
+		failover: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ha_elected_replica_changes_total",
+				Help: "Total number of times a different HA replica was elected.",
+			},
+			[]string{"tenant", "cluster"},
+		),
+	}
+	prometheus.MustRegister(t.deduped, t.failover)
+	return t
+}
+
+// accept reports whether samples of replica should be written, electing it
+// if its cluster has no live leader.
+func (t *haTracker) accept(cluster haCluster, replica string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.elected[cluster]
+	if !ok {
+		t.elected[cluster] = &haReplica{name: replica, lastSeen: now}
+		return true
+	}
+	if r.name == replica {
+		r.lastSeen = now
+		return true
+	}
+	if now.Sub(r.lastSeen) > t.timeout {
+		fmt.Printf("HA cluster %q of tenant %q: replica %q timed out, electing %q\n", cluster.name, cluster.tenant, r.name, replica)
+		r.name = replica
+		r.lastSeen = now
+		t.failover.WithLabelValues(cluster.tenant, cluster.name).Inc()
+		return true
+	}
+	return false
+}
+
+// filter drops the series of non-elected replicas and strips the replica
+// label from the rest, so both replicas write the same series. Series
+// without a replica label are kept as they are.
+func (t *haTracker) filter(tenant string, series []*remote.TimeSeries) []*remote.TimeSeries {
+	now := time.Now()
+	// all series of a request normally come from the same replica
+	decided := make(map[[2]string]bool)
+
+	kept := series[:0]
+	for _, s := range series {
+		var cluster, replica string
+		idx := -1
+		for i, l := range s.Labels {
+			switch l.Name {
+			case t.clusterLabel:
+				cluster = l.Value
+			case t.replicaLabel:
+				replica = l.Value
+				idx = i
+			}
+		}
+		if idx < 0 {
+			kept = append(kept, s)
+			continue
+		}
+
+		key := [2]string{cluster, replica}
+		ok, seen := decided[key]
+		if !seen {
+			ok = t.accept(haCluster{tenant: tenant, name: cluster}, replica, now)
+			decided[key] = ok
+		}
+		if !ok {
+			t.deduped.WithLabelValues(tenant, cluster).Add(float64(len(s.Samples)))
+			continue
+		}
+
+		labels := make([]*remote.LabelPair, 0, len(s.Labels)-1)
+		labels = append(labels, s.Labels[:idx]...)
+		s.Labels = append(labels, s.Labels[idx+1:]...)
+		kept = append(kept, s)
+	}
+	return kept
+}
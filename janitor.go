@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prom2click/database"
+	"github.com/prom2click/job"
+	"github.com/prom2click/schema"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var partitionsSQL = `SELECT table, partition, sum(bytes), sum(rows), max(max_date)
+	FROM system.parts WHERE database = ? AND active GROUP BY table, partition`
+
+// janitor periodically exports the size and age of every partition and, if
+// enabled, drops partitions past their job's retention for servers whose
+// table engines do not support TTL.
+type janitor struct {
+	conf    *config
+	jm      *job.JobManager
+	db      *database.Pool
+	opts    schema.Options
+	bytes   *prometheus.GaugeVec
+	rows    *prometheus.GaugeVec
+	age     *prometheus.GaugeVec
+	dropped prometheus.Counter
+}
+
+func newJanitor(conf *config, jm *job.JobManager) (*janitor, error) {
+	db, err := database.Open(conf.dsn, 2, 1)
+	if err != nil {
+		return nil, err
+	}
+	j := &janitor{
+		conf: conf,
+		jm:   jm,
+		db:   db,
+		opts: schemaOptions(conf),
+		bytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clickhouse_partition_bytes",
+				Help: "Size of the active parts of a partition in bytes.",
+			},
+			[]string{"table", "partition"},
+		),
+		rows: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clickhouse_partition_rows",
+				Help: "Number of rows in the active parts of a partition.",
+			},
+			[]string{"table", "partition"},
+		),
+		age: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clickhouse_partition_age_seconds",
+				Help: "Time since the newest date in a partition.",
+			},
+			[]string{"table", "partition"},
+		),
+		dropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "clickhouse_partitions_dropped_total",
+				Help: "Total number of partitions dropped for being past their retention.",
+			},
+		),
+	}
+	prometheus.MustRegister(j.bytes, j.rows, j.age, j.dropped)
+	return j, nil
+}
+
+// retentions maps the local tables holding data to how long it is kept,
+// according to the current job config.
+func (j *janitor) retentions() map[string]time.Duration {
+	ret := make(map[string]time.Duration)
+	for _, jb := range j.jm.Snapshot().Config.Jobs {
+		raw, rollup, err := jb.Retentions()
+		if err != nil {
+			continue
+		}
+		if raw > 0 {
+			ret[j.opts.LocalName(schema.Table{Name: jb.Table})] = raw
+		}
+		if rollup > 0 {
+			for _, r := range j.conf.spec.Rollups {
+				ret[j.opts.LocalName(schema.Table{Name: r.TableName(jb.Table)})] = rollup
+			}
+		}
+	}
+	return ret
+}
+
+func (j *janitor) run() {
+	rows, err := j.db.DB().Query(partitionsSQL, j.conf.ChDB)
+	if err != nil {
+		fmt.Printf("Error: janitor: %s\n", err)
+		return
+	}
+
+	type partition struct {
+		table, name string
+		maxDate     time.Time
+	}
+	var expired []partition
+	retentions := j.retentions()
+	now := time.Now()
+
+	j.bytes.Reset()
+	j.rows.Reset()
+	j.age.Reset()
+	for rows.Next() {
+		var p partition
+		var nbytes, nrows uint64
+		if err = rows.Scan(&p.table, &p.name, &nbytes, &nrows, &p.maxDate); err != nil {
+			fmt.Printf("Error: janitor: scan: %s\n", err)
+			break
+		}
+		j.bytes.WithLabelValues(p.table, p.name).Set(float64(nbytes))
+		j.rows.WithLabelValues(p.table, p.name).Set(float64(nrows))
+		j.age.WithLabelValues(p.table, p.name).Set(now.Sub(p.maxDate).Seconds())
+
+		// the whole partition must be older than the retention
+		if ret, ok := retentions[p.table]; ok && now.Sub(p.maxDate.Add(24*time.Hour)) > ret {
+			expired = append(expired, p)
+		}
+	}
+	rows.Close()
+
+	if !j.conf.JanitorDropExpired {
+		return
+	}
+	for _, p := range expired {
+		stmt := fmt.Sprintf("ALTER TABLE %s.%s%s DROP PARTITION %s", j.conf.ChDB, p.table, j.opts.OnCluster(), p.name)
+		fmt.Printf("janitor: dropping expired partition: %s\n", stmt)
+		if _, err := j.db.DB().Exec(stmt); err != nil {
+			fmt.Printf("Error: janitor: %s\n", err)
+			continue
+		}
+		j.dropped.Inc()
+	}
+}
+
+// Start runs the janitor every interval.
+func (j *janitor) Start(interval time.Duration) {
+	go func() {
+		j.run()
+		for range time.Tick(interval) {
+			j.run()
+		}
+	}()
+}
@@ -4,59 +4,104 @@ import (
 	"github.com/prom2click/config"
 	pro "github.com/prom2click/protocal"
 	"fmt"
+	"sync"
 )
 
 type JobManager struct {
-	jobs map[string]chan *pro.K8sRequest
-	cfm  *config.ConfigManager
+	mu       sync.RWMutex
+	jobs     map[string]chan *pro.K8sRequest
+	cfm      *config.ConfigManager
+	capacity int
 }
 
 //新建jobmanager，新建jobmanager读取配置文件，目前不支持指定配置文件路径，配置文件改变会影响到configmanager中保存的jobmap
 //新建的jobmanager根据job数量建立job  channel ,从而数据写入解析到job后进入到不同的channel中，写入到不同的表中。
 //如果job名字不匹配，那么，数据就会被过滤出去
-func NewJobManager(capacity int) (jm *JobManager, err error) {
+//validators会在启动和配置重载时对配置进行额外校验，校验失败时启动失败或保留旧配置
+func NewJobManager(capacity int, validators ...config.Validator) (jm *JobManager, err error) {
 
-	config := config.NewConfigManager()
-	err = config.Load()
+	jm = NewJobManagerOf(capacity, config.NewConfigManager(validators...))
+	err = jm.cfm.Load()
 	if err != nil {
 		return nil, err
 	}
 
-	jm = &JobManager{
-		jobs: nil,
-		cfm:  config,
-	}
+	return jm, nil
+}
 
-	tmp := jm.cfm.GetJobMap()
-	jm.jobs = make(map[string]chan *pro.K8sRequest, len(tmp))
-	for jobname, _ := range tmp {
-		jm.jobs[jobname] = make(chan *pro.K8sRequest, capacity)
+//基于已有的configmanager新建jobmanager，不读取配置文件，配置由调用方通过Apply生效，测试中使用
+func NewJobManagerOf(capacity int, cfm *config.ConfigManager) *JobManager {
+	jm := &JobManager{
+		jobs:     make(map[string]chan *pro.K8sRequest),
+		cfm:      cfm,
+		capacity: capacity,
 	}
 
-	return jm, nil
+	//先于其他订阅者订阅，保证它们收到新配置时channel已经建好
+	jm.cfm.Subscribe(jm.update)
+	jm.update(cfm.Snapshot())
+	return jm
 }
 
-//返回一个只写channel
-func (jm *JobManager) GetChannelAccordingJobname(jobname string) (chan<- *pro.K8sRequest, error) {
-	val, ok := jm.jobs[jobname]
-	if ok {
-		return val, nil
-	} else {
-		return nil, fmt.Errorf("job not found")
+//根据新配置增加新job的channel，删除已移除job的channel；channel不会被关闭，对应writer收到配置后自行退出
+func (jm *JobManager) update(snap *config.Snapshot) {
+	jobmap := snap.JobMap()
+
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	for jobname := range jm.jobs {
+		if _, ok := jobmap[jobname]; !ok {
+			delete(jm.jobs, jobname)
+		}
+	}
+	for jobname := range jobmap {
+		if _, ok := jm.jobs[jobname]; !ok {
+			jm.jobs[jobname] = make(chan *pro.K8sRequest, jm.capacity)
+		}
 	}
 }
 
-func (jm *JobManager) GetTableAccordingJobName(jobname string) string {
-	jobmap := jm.cfm.GetJobMap()
-	table, ok := jobmap[jobname]
-	if ok {
-		return table
-	} else {
-		return ""
+//把请求发送到job对应的channel，发送期间持有读锁，保证job被移除后不会再有请求进入其channel
+func (jm *JobManager) Send(jobname string, req *pro.K8sRequest) error {
+	jm.mu.RLock()
+	defer jm.mu.RUnlock()
+	channel, ok := jm.jobs[jobname]
+	if !ok {
+		return fmt.Errorf("job not found")
 	}
-	return ""
+	channel <- req
+	return nil
+}
+
+//返回job对应的channel，供writer读取
+func (jm *JobManager) Channel(jobname string) (<-chan *pro.K8sRequest, bool) {
+	jm.mu.RLock()
+	defer jm.mu.RUnlock()
+	channel, ok := jm.jobs[jobname]
+	return channel, ok
+}
+
+func (jm *JobManager) GetTableAccordingJobName(jobname string) string {
+	table, _ := jm.cfm.Snapshot().Table(jobname)
+	return table
+}
+
+//当前生效的配置
+func (jm *JobManager) Snapshot() *config.Snapshot {
+	return jm.cfm.Snapshot()
+}
+
+//订阅配置变化，回调在jobmanager更新完channel之后执行
+func (jm *JobManager) Subscribe(fn func(*config.Snapshot)) (unsubscribe func()) {
+	return jm.cfm.Subscribe(fn)
+}
+
+//读取并校验配置文件但不生效，与其他文件一起重载时先全部读取校验，再调用Apply
+func (jm *JobManager) ReadConfig() (*config.Config, error) {
+	return jm.cfm.Read()
 }
 
-func (jm *JobManager) GetJobs() map[string]chan *pro.K8sRequest {
-	return jm.jobs
+//使ReadConfig返回的配置生效并通知订阅者
+func (jm *JobManager) Apply(cfg *config.Config) {
+	jm.cfm.Apply(cfg)
 }
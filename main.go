@@ -1,10 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/prom2click/database"
+	"github.com/prom2click/schema"
 )
 
 // a lot of this borrows directly from:
@@ -13,8 +20,21 @@ import (
 type config struct {
 	//tcp://host1:9000?username=user&password=qwerty&database=clicks&read_timeout=10&write_timeout=20&alt_hosts=host2:9000,host3:9000
 	ChDSN           string
+	ChHost          string
+	ChUsername      string
+	ChUsernameFile  string
+	ChPasswordFile  string
+	ChCredsRefresh  time.Duration
+	ChTLS           bool
+	ChTLSSkipVerify bool
+	ChTLSCAFile     string
+	ChTLSCertFile   string
+	ChTLSKeyFile    string
 	ChDB            string
 	ChTable         string
+	ChLayout        string
+	ChSeriesCache   int
+	ChRollups       string
 	ChBatch         int
 	ChanSize        int
 	CHQuantile      float64
@@ -24,6 +44,66 @@ type config struct {
 	HTTPAddr        string
 	HTTPWritePath   string
 	HTTPMetricsPath string
+	HTTPAuthFile    string
+	WebConfigFile   string
+
+	APIMetadataCacheTTL time.Duration
+	APIQueryTimeout     time.Duration
+	APIMaxConcurrency   int
+	ReadConcurrency     int
+	ReadMaxInflight     int
+	ReadSplitInterval   time.Duration
+	ReadLocalTables     bool
+	ReadDSN             string
+
+	ReadMaxRange               time.Duration
+	ReadMaxSeries              int
+	ReadMaxSamples             int
+	ReadMaxRowsToRead          int
+	ReadMaxExecutionTime       time.Duration
+	ReadRequireEqualityMatcher bool
+
+	ReadCacheSize      int64
+	ReadCacheDir       string
+	ReadCacheChunk     time.Duration
+	ReadCacheFreshness time.Duration
+	ReadCacheTTL       time.Duration
+
+	WriteUnrouted  string
+	FallbackTable  string
+	HAClusterLabel string
+	HAReplicaLabel string
+	HATimeout      time.Duration
+
+	LimitsMaxSeries       int
+	LimitsMaxTenantSeries int
+	LimitsMaxLabels       int
+	LimitsAction          string
+	LimitsMaxTracked      int
+	LimitsIdleTimeout     time.Duration
+
+	TenantEnabled bool
+	TenantHeader  string
+	TenantDefault string
+
+	SchemaCluster     string
+	SchemaReplicated  bool
+	SchemaZKPath      string
+	SchemaReplica     string
+	SchemaDistributed bool
+	SchemaLocalSuffix string
+	SchemaDryRun      bool
+
+	JanitorInterval    time.Duration
+	JanitorDropExpired bool
+
+	// dsn is ChDSN with the host and credentials applied, see buildDSN
+	dsn *database.DSN
+	// readDSN is ReadDSN, or ChDSN if empty, with the same host and
+	// credentials applied
+	readDSN *database.DSN
+	// spec are the tables backing each job table
+	spec schema.Spec
 }
 
 var (
@@ -44,7 +124,32 @@ func main() {
 		os.Exit(excode)
 	}
 
+	if err := buildDSN(conf); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		os.Exit(checkConfig(conf))
+	case "schema":
+		os.Exit(schemaCommand(conf, flag.Arg(1)))
+	default:
+		fmt.Printf("Error: unknown command %q\n", flag.Arg(0))
+		os.Exit(1)
+	}
+
+	go conf.dsn.Watch(conf.ChCredsRefresh)
+	if conf.readDSN != conf.dsn {
+		go conf.readDSN.Watch(conf.ChCredsRefresh)
+	}
+
 	fmt.Println("Starting up..")
+	fmt.Printf("Using clickhouse %s\n", conf.dsn)
+	if conf.readDSN != conf.dsn {
+		fmt.Printf("Using clickhouse %s for reads\n", conf.readDSN)
+	}
 
 	srv, err := NewP2CServer(conf)
 	if err != nil {
@@ -69,6 +174,17 @@ func parseFlags() *config {
 	// print version?
 	flag.BoolVar(&versionFlag, "version", false, "Version")
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  check-config   validate the job config and clickhouse tables, then exit")
+		fmt.Fprintln(os.Stderr, "  schema init    create the database and the tables of the job config")
+		fmt.Fprintln(os.Stderr, "  schema diff    show how the live tables differ from the expected schema")
+		fmt.Fprintln(os.Stderr, "  schema migrate alter the live tables to match the expected schema")
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flag.PrintDefaults()
+	}
+
 	// clickhouse dsn
 	ddsn := "tcp://127.0.0.1:9000?username=&password=&database=metrics&" +
 		"read_timeout=10&write_timeout=10&alt_hosts="
@@ -76,7 +192,46 @@ func parseFlags() *config {
 		"The clickhouse server DSN to write to eg."+
 			"tcp://host1:9000?username=user&password=qwerty&database=clicks&"+
 			"read_timeout=10&write_timeout=20&alt_hosts=host2:9000,host3:9000"+
-			"(see https://github.com/kshvakov/clickhouse).",
+			"(see https://github.com/ClickHouse/clickhouse-go). "+
+			"Defaults to $PROM2CLICK_CH_DSN if set. Prefer passing credentials "+
+			"with the options below, the DSN shows up in ps output.",
+	)
+
+	// clickhouse dsn components, these override what is in ch.dsn
+	flag.StringVar(&cfg.ChHost, "ch.host", "",
+		"The clickhouse host:port, overrides the ch.dsn host. "+
+			"Can also be set with $PROM2CLICK_CH_HOST.",
+	)
+	flag.StringVar(&cfg.ChUsername, "ch.username", "",
+		"The clickhouse username, overrides the ch.dsn username. "+
+			"Can also be set with $PROM2CLICK_CH_USERNAME.",
+	)
+	flag.StringVar(&cfg.ChUsernameFile, "ch.username-file", "",
+		"File to read the clickhouse username from, takes precedence over ch.username.",
+	)
+	flag.StringVar(&cfg.ChPasswordFile, "ch.password-file", "",
+		"File to read the clickhouse password from (eg. a mounted kubernetes secret). "+
+			"Otherwise the password is taken from $PROM2CLICK_CH_PASSWORD or ch.dsn.",
+	)
+	flag.DurationVar(&cfg.ChCredsRefresh, "ch.credentials-refresh", time.Minute,
+		"How often to re-read the clickhouse credential files and environment, "+
+			"connections are re-established when they change.",
+	)
+	flag.BoolVar(&cfg.ChTLS, "ch.tls", false,
+		"Connect to clickhouse with TLS (its tcp_port_secure), verifying the server certificate.",
+	)
+	flag.BoolVar(&cfg.ChTLSSkipVerify, "ch.tls-skip-verify", false,
+		"Do not verify the clickhouse server certificate, for testing only.",
+	)
+	flag.StringVar(&cfg.ChTLSCAFile, "ch.tls-ca-file", "",
+		"The CA certificates to verify the clickhouse server certificate with instead of the system ones.",
+	)
+	flag.StringVar(&cfg.ChTLSCertFile, "ch.tls-cert-file", "",
+		"The client certificate to authenticate to clickhouse with, requires ch.tls-key-file. "+
+			"It is re-read for every new connection so rotated certificates are picked up.",
+	)
+	flag.StringVar(&cfg.ChTLSKeyFile, "ch.tls-key-file", "",
+		"The key of ch.tls-cert-file.",
 	)
 
 	// clickhouse db
@@ -89,6 +244,25 @@ func parseFlags() *config {
 		"The clickhouse table to write to.",
 	)
 
+	// clickhouse storage layout
+	flag.StringVar(&cfg.ChLayout, "ch.layout", string(schema.LayoutWide),
+		"How samples are stored: wide (every sample row carries all its labels) or "+
+			"split (labels are written once per series to <table>_series, samples "+
+			"only carry the series fingerprint).",
+	)
+	flag.IntVar(&cfg.ChSeriesCache, "ch.series-cache", 1000000,
+		"Number of series fingerprints each writer remembers as already written "+
+			"to the series table in the split layout.",
+	)
+
+	// pre-aggregated rollup tables
+	flag.StringVar(&cfg.ChRollups, "ch.rollups", "",
+		"Comma separated resolutions of the rollup tables kept next to every "+
+			"samples table, eg. 1m,5m,1h. Reads use the coarsest rollup that fits "+
+			"the step of the query. Rollups store the ch.quantile state, changing "+
+			"ch.quantile requires recreating them.",
+	)
+
 	// clickhouse insertion batch size
 	flag.IntVar(&cfg.ChBatch, "ch.batch", 8192,
 		"Clickhouse write batch size (n metrics).",
@@ -140,6 +314,183 @@ func parseFlags() *config {
 		"Address to listen on for metric requests.",
 	)
 
+	// prometheus HTTP API
+	flag.DurationVar(&cfg.APIMetadataCacheTTL, "api.metadata-cache-ttl", time.Minute,
+		"How long label names, label values and series lookups are cached, 0 disables the cache.",
+	)
+	flag.DurationVar(&cfg.APIQueryTimeout, "api.query-timeout", 2*time.Minute,
+		"How long a query of the PromQL engine may run.",
+	)
+	flag.IntVar(&cfg.APIMaxConcurrency, "api.query-max-concurrency", 20,
+		"How many queries the PromQL engine evaluates at once, further queries wait.",
+	)
+
+	// concurrency of reads
+	flag.IntVar(&cfg.ReadConcurrency, "read.concurrency", 4,
+		"How many clickhouse queries a single read request runs concurrently, "+
+			"including the sub-queries of split reads.",
+	)
+	flag.IntVar(&cfg.ReadMaxInflight, "read.max-inflight-queries", 16,
+		"How many read queries may run against clickhouse at once across all requests, "+
+			"further queries wait for a slot. 0 is unlimited.",
+	)
+
+	flag.DurationVar(&cfg.ReadSplitInterval, "read.split-interval", 24*time.Hour,
+		"Reads longer than this are split into sub-queries aligned to multiples of it "+
+			"counted from a monday (24h: days, 168h: the weekly partitions) that run in parallel. "+
+			"0 disables splitting.",
+	)
+
+	flag.BoolVar(&cfg.ReadLocalTables, "read.local-tables", false,
+		"With schema.distributed, read the local tables of the connected clickhouse "+
+			"instead of the Distributed tables, eg. when every replica holds all data.",
+	)
+	flag.StringVar(&cfg.ReadDSN, "read.dsn", "",
+		"A clickhouse DSN used for reads only, eg. a read-only replica. The credential "+
+			"and TLS flags apply to it too, ch.host does not. Defaults to ch.dsn.",
+	)
+
+	// guardrails of reads
+	flag.DurationVar(&cfg.ReadMaxRange, "read.max-range", 0,
+		"The longest time range a read query may cover, eg. 31d. 0 is unlimited.",
+	)
+	flag.IntVar(&cfg.ReadMaxSeries, "read.max-series", 0,
+		"The most series a read query may return. 0 is unlimited.",
+	)
+	flag.IntVar(&cfg.ReadMaxSamples, "read.max-samples", 0,
+		"The most samples (aggregated points) a read query may return. 0 is unlimited.",
+	)
+	flag.IntVar(&cfg.ReadMaxRowsToRead, "read.max-rows-to-read", 0,
+		"The most rows clickhouse may scan for a read query (max_rows_to_read). 0 is unlimited.",
+	)
+	flag.DurationVar(&cfg.ReadMaxExecutionTime, "read.max-execution-time", 0,
+		"How long clickhouse may run a read query (max_execution_time, whole seconds). 0 is unlimited.",
+	)
+	flag.BoolVar(&cfg.ReadRequireEqualityMatcher, "read.require-equality-matcher", false,
+		"Reject read queries without at least one equality matcher with a non-empty value, "+
+			"such as {job=\"api\"}, so a query can't scan every series.",
+	)
+
+	// remote read results cache
+	flag.Int64Var(&cfg.ReadCacheSize, "read.cache-size", 0,
+		"How many bytes of remote read results to cache in memory. 0 disables the cache.",
+	)
+	flag.StringVar(&cfg.ReadCacheDir, "read.cache-dir", "",
+		"A directory to cache remote read results on disk too, so they survive restarts.",
+	)
+	flag.DurationVar(&cfg.ReadCacheChunk, "read.cache-chunk", time.Hour,
+		"Remote reads are cached in chunks of this length, rounded up to whole steps.",
+	)
+	flag.DurationVar(&cfg.ReadCacheFreshness, "read.cache-max-freshness", 10*time.Minute,
+		"Chunks ending less than this long ago are always queried, samples may still arrive for them.",
+	)
+	flag.DurationVar(&cfg.ReadCacheTTL, "read.cache-ttl", 24*time.Hour,
+		"How long cached chunks are kept.",
+	)
+
+	// tls of the http server
+	flag.StringVar(&cfg.WebConfigFile, "web.config.file", "",
+		"A web config file in the format of the prometheus exporter-toolkit enabling TLS "+
+			"(tls_server_config). Certificates are reloaded when they change.",
+	)
+
+	// credentials of writers, readers and admins
+	flag.StringVar(&cfg.HTTPAuthFile, "web.auth-file", "",
+		"A yaml file with the basic auth users and bearer tokens allowed to write, read "+
+			"or administrate (reload, debug pages), re-read on reload. Empty disables auth.",
+	)
+
+	// what to do with series of jobs missing from the job config
+	flag.StringVar(&cfg.WriteUnrouted, "write.unrouted", unroutedDrop,
+		"What to do with series whose job is not in the job config: "+
+			"drop (count and discard), fallback (write to write.fallback-table) "+
+			"or reject (fail the whole remote write request with a 400).",
+	)
+	flag.StringVar(&cfg.FallbackTable, "write.fallback-table", "",
+		"The clickhouse table unrouted series are written to when write.unrouted=fallback.",
+	)
+
+	// deduplication of prometheus HA pairs
+	flag.StringVar(&cfg.HAReplicaLabel, "ha.replica-label", "",
+		"The label telling the replicas of a prometheus HA pair apart (eg. __replica__). "+
+			"Only the samples of one elected replica per ha.cluster-label are written and "+
+			"the label is stripped. Empty disables deduplication.",
+	)
+	flag.StringVar(&cfg.HAClusterLabel, "ha.cluster-label", "cluster",
+		"The label identifying the HA pair a replica belongs to.",
+	)
+	flag.DurationVar(&cfg.HATimeout, "ha.failover-timeout", 30*time.Second,
+		"How long the elected replica may not send samples before another replica is elected.",
+	)
+
+	// cardinality limits
+	flag.IntVar(&cfg.LimitsMaxSeries, "limits.max-series-per-job", 0,
+		"The maximum number of active series per job, 0 is unlimited. "+
+			"Can be overridden per job with max_series in the job config.",
+	)
+	flag.IntVar(&cfg.LimitsMaxTenantSeries, "limits.max-series-per-tenant", 0,
+		"The maximum number of active series per tenant, 0 is unlimited.",
+	)
+	flag.IntVar(&cfg.LimitsMaxLabels, "limits.max-labels-per-series", 0,
+		"The maximum number of labels of a series including the metric name, 0 is unlimited.",
+	)
+	flag.StringVar(&cfg.LimitsAction, "limits.action", limitReject,
+		"What to do with series over a limit: reject (skip them and fail the remote write request "+
+			"with a 400) or drop (skip them silently). Both count them in discarded_samples_total.",
+	)
+	flag.IntVar(&cfg.LimitsMaxTracked, "limits.max-tracked-series", 1<<22,
+		"The maximum number of active series tracked over all tenants and jobs. New series beyond "+
+			"are handled like series over a limit, which bounds the memory used for tracking.",
+	)
+	flag.DurationVar(&cfg.LimitsIdleTimeout, "limits.series-idle-timeout", time.Hour,
+		"How long a series no longer written to counts as active.",
+	)
+
+	// multi-tenancy
+	flag.BoolVar(&cfg.TenantEnabled, "tenant.enabled", false,
+		"Store the tenant of every series and scope reads to the tenant of the request. "+
+			"The tenant is taken from the path (eg. /write/<tenant>), tenant.header or tenant.default.",
+	)
+	flag.StringVar(&cfg.TenantHeader, "tenant.header", "X-Scope-OrgID",
+		"The HTTP header carrying the tenant id.",
+	)
+	flag.StringVar(&cfg.TenantDefault, "tenant.default", "",
+		"The tenant of requests not naming one, empty rejects them.",
+	)
+
+	// table layout used by the schema command
+	flag.StringVar(&cfg.SchemaCluster, "schema.cluster", "",
+		"The clickhouse cluster to run schema statements ON CLUSTER and to distribute tables over.",
+	)
+	flag.BoolVar(&cfg.SchemaReplicated, "schema.replicated", false,
+		"Create tables with the Replicated* table engines.",
+	)
+	flag.StringVar(&cfg.SchemaZKPath, "schema.zk-path", "/clickhouse/tables/{shard}/%s",
+		"The zookeeper path of replicated tables, %s is replaced by database.table.",
+	)
+	flag.StringVar(&cfg.SchemaReplica, "schema.replica", "{replica}",
+		"The replica name of replicated tables.",
+	)
+	flag.BoolVar(&cfg.SchemaDistributed, "schema.distributed", false,
+		"Store the data in <table><schema.local-suffix> on every shard of schema.cluster "+
+			"and create <table> as a Distributed table over them.",
+	)
+	flag.StringVar(&cfg.SchemaLocalSuffix, "schema.local-suffix", "_local",
+		"The suffix of the local tables behind Distributed tables.",
+	)
+	flag.BoolVar(&cfg.SchemaDryRun, "schema.dry-run", false,
+		"Only print the statements the schema command would run.",
+	)
+
+	// partition metrics and retention for engines without TTL
+	flag.DurationVar(&cfg.JanitorInterval, "janitor.interval", 10*time.Minute,
+		"How often to export partition sizes and ages, 0 disables the janitor.",
+	)
+	flag.BoolVar(&cfg.JanitorDropExpired, "janitor.drop-expired", false,
+		"Drop partitions past the retention of their job. Only needed if your "+
+			"clickhouse does not support TTL, run it on a single prom2click instance.",
+	)
+
 	// http shutdown and request timeout
 	flag.DurationVar(&cfg.HTTPTimeout, "web.timeout", 30*time.Second,
 		"The timeout to use for HTTP requests and server shutdown. Defaults to 30s.",
@@ -147,5 +498,149 @@ func parseFlags() *config {
 
 	flag.Parse()
 
+	// $PROM2CLICK_CH_DSN is applied after parsing rather than as the flag
+	// default, which the usage would print including the password
+	chDSNSet := false
+	flag.Visit(func(f *flag.Flag) { chDSNSet = chDSNSet || f.Name == "ch.dsn" })
+	if env := os.Getenv("PROM2CLICK_CH_DSN"); env != "" && !chDSNSet {
+		cfg.ChDSN = env
+	}
+
+	switch schema.Layout(cfg.ChLayout) {
+	case schema.LayoutWide, schema.LayoutSplit:
+	default:
+		fmt.Printf("Error: invalid ch.layout %q\n", cfg.ChLayout)
+		os.Exit(1)
+	}
+
+	rollups, err := schema.ParseRollups(cfg.ChRollups)
+	if err != nil {
+		fmt.Printf("Error: ch.rollups: %s\n", err)
+		os.Exit(1)
+	}
+	cfg.spec = schema.Spec{
+		Layout:   schema.Layout(cfg.ChLayout),
+		Rollups:  rollups,
+		Quantile: cfg.CHQuantile,
+		Tenants:  cfg.TenantEnabled,
+	}
+
+	switch cfg.WriteUnrouted {
+	case unroutedDrop, unroutedReject:
+	case unroutedFallback:
+		if cfg.FallbackTable == "" {
+			fmt.Println("Error: write.unrouted=fallback requires write.fallback-table")
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("Error: invalid write.unrouted %q\n", cfg.WriteUnrouted)
+		os.Exit(1)
+	}
+
+	if cfg.TenantDefault != "" && !tenantRE.MatchString(cfg.TenantDefault) {
+		fmt.Printf("Error: invalid tenant.default %q\n", cfg.TenantDefault)
+		os.Exit(1)
+	}
+
+	switch cfg.LimitsAction {
+	case limitReject, limitDrop:
+	default:
+		fmt.Printf("Error: invalid limits.action %q\n", cfg.LimitsAction)
+		os.Exit(1)
+	}
+
+	if cfg.LimitsMaxTracked < 1 {
+		fmt.Println("Error: limits.max-tracked-series must be at least 1")
+		os.Exit(1)
+	}
+
+	if cfg.APIMaxConcurrency < 1 {
+		fmt.Println("Error: api.query-max-concurrency must be at least 1")
+		os.Exit(1)
+	}
+
+	if (cfg.ChTLSCertFile == "") != (cfg.ChTLSKeyFile == "") {
+		fmt.Println("Error: ch.tls-cert-file and ch.tls-key-file must be set together")
+		os.Exit(1)
+	}
+	if !cfg.ChTLS && (cfg.ChTLSCAFile != "" || cfg.ChTLSCertFile != "" || cfg.ChTLSSkipVerify) {
+		fmt.Println("Error: ch.tls-ca-file, ch.tls-cert-file and ch.tls-skip-verify require ch.tls")
+		os.Exit(1)
+	}
+
+	if cfg.HAReplicaLabel != "" && cfg.HAReplicaLabel == cfg.HAClusterLabel {
+		fmt.Println("Error: ha.replica-label and ha.cluster-label must differ")
+		os.Exit(1)
+	}
+
 	return cfg
 }
+
+// buildDSN resolves the clickhouse DSN from ch.dsn and the separately
+// configured host and credentials.
+func buildDSN(cfg *config) error {
+	cfg.dsn = &database.DSN{
+		Base:       cfg.ChDSN,
+		Host:       database.Credential{Value: cfg.ChHost, Env: "PROM2CLICK_CH_HOST"},
+		Username:   database.Credential{Value: cfg.ChUsername, Env: "PROM2CLICK_CH_USERNAME", File: cfg.ChUsernameFile},
+		Password:   database.Credential{Env: "PROM2CLICK_CH_PASSWORD", File: cfg.ChPasswordFile},
+		TLS:        cfg.ChTLS,
+		SkipVerify: cfg.ChTLSSkipVerify,
+	}
+	if cfg.ChTLS {
+		if err := registerChTLS(cfg); err != nil {
+			return err
+		}
+		cfg.dsn.TLSConfig = chTLSConfigName
+	}
+	if err := cfg.dsn.Load(); err != nil {
+		return err
+	}
+
+	cfg.readDSN = cfg.dsn
+	if cfg.ReadDSN != "" {
+		cfg.readDSN = &database.DSN{
+			Base:       cfg.ReadDSN,
+			Username:   cfg.dsn.Username,
+			Password:   cfg.dsn.Password,
+			TLS:        cfg.ChTLS,
+			SkipVerify: cfg.ChTLSSkipVerify,
+			TLSConfig:  cfg.dsn.TLSConfig,
+		}
+		return cfg.readDSN.Load()
+	}
+	return nil
+}
+
+// the name the clickhouse tls config is registered with the driver as
+const chTLSConfigName = "prom2click"
+
+// registerChTLS registers the tls config of the ch.tls-* flags with the
+// clickhouse driver.
+func registerChTLS(cfg *config) error {
+	c := &tls.Config{InsecureSkipVerify: cfg.ChTLSSkipVerify}
+	if cfg.ChTLSCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.ChTLSCAFile)
+		if err != nil {
+			return fmt.Errorf("reading ch.tls-ca-file: %s", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in ch.tls-ca-file %s", cfg.ChTLSCAFile)
+		}
+	}
+	if cfg.ChTLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.ChTLSCertFile, cfg.ChTLSKeyFile); err != nil {
+			return fmt.Errorf("loading ch.tls-cert-file: %s", err)
+		}
+		certFile, keyFile := cfg.ChTLSCertFile, cfg.ChTLSKeyFile
+		c.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading ch.tls-cert-file: %s", err)
+			}
+			return &cert, nil
+		}
+	}
+	return clickhouse.RegisterTLSConfig(chTLSConfigName, c)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prom2click/schema"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// metadataCacheMax is the most metadata results cached at once
+const metadataCacheMax = 1000
+
+// metadataWhere returns the tables and label array column label metadata is
+// read from and the condition selecting the series of tenant matching any of
+// the selectors. The samples table of the wide layout is restricted to the
+// whole days of the time range; the series table of the split layout has no
+// timestamps, so the time range does not apply to it.
+func (r *p2cReader) metadataWhere(tenant string, selectors [][]*remote.LabelMatcher, start, end time.Time) (tables []string, labels, where string) {
+	var conds []string
+	for _, t := range r.readTablesOf(selectors) {
+		if schema.Layout(r.conf.ChLayout) == schema.LayoutSplit {
+			t += schema.SeriesSuffix
+		}
+		tables = append(tables, r.tableName(t))
+	}
+	if schema.Layout(r.conf.ChLayout) == schema.LayoutSplit {
+		labels = "labels"
+	} else {
+		labels = "tags"
+		day := int64(24 * time.Hour / time.Second)
+		from := start.Unix() / day * day
+		to := (end.Unix() + day - 1) / day * day
+		conds = append(conds, fmt.Sprintf("date >= toDate(%d) AND date <= toDate(%d)", from, to))
+	}
+	if r.conf.spec.Tenants {
+		conds = append(conds, "tenant = "+quoteString(tenant))
+	}
+
+	var any []string
+	for _, sel := range selectors {
+		all := []string{"1"}
+		for _, m := range sel {
+			all = append(all, seriesCondition(m, labels))
+		}
+		any = append(any, "("+strings.Join(all, " AND ")+")")
+	}
+	if len(any) > 0 {
+		conds = append(conds, "("+strings.Join(any, " OR ")+")")
+	}
+	if len(conds) == 0 {
+		conds = append(conds, "1")
+	}
+	return tables, labels, strings.Join(conds, " AND ")
+}
+
+// queryStrings runs a query returning a single string column.
+func (r *p2cReader) queryStrings(ctx context.Context, query string) ([]string, error) {
+	values := []string{}
+	if query == "" {
+		return values, nil
+	}
+	release, err := r.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	rows, err := r.db.DB().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v string
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// LabelNames returns the sorted label names of the series of tenant matching
+// any of the selectors, or of all series without selectors.
+func (r *p2cReader) LabelNames(ctx context.Context, tenant string, selectors [][]*remote.LabelMatcher, start, end time.Time) ([]string, error) {
+	tables, labels, where := r.metadataWhere(tenant, selectors, start, end)
+	return r.queryStrings(ctx, metadataSQL("label", tables, func(table string) string {
+		return fmt.Sprintf("SELECT arrayJoin(arrayMap(x -> substring(x, 1, position(x, '=') - 1), %s)) AS label FROM %s.%s WHERE %s",
+			labels, r.conf.ChDB, table, where)
+	}))
+}
+
+// LabelValues returns the sorted values of the label name.
+func (r *p2cReader) LabelValues(ctx context.Context, tenant, name string, selectors [][]*remote.LabelMatcher, start, end time.Time) ([]string, error) {
+	tables, labels, where := r.metadataWhere(tenant, selectors, start, end)
+	if name == model.MetricNameLabel {
+		// promoted to a column of its own
+		return r.queryStrings(ctx, metadataSQL("value", tables, func(table string) string {
+			return fmt.Sprintf("SELECT name AS value FROM %s.%s WHERE %s", r.conf.ChDB, table, where)
+		}))
+	}
+	prefix := name + "="
+	return r.queryStrings(ctx, metadataSQL("value", tables, func(table string) string {
+		return fmt.Sprintf("SELECT substring(arrayJoin(arrayFilter(x -> position(x, %s) = 1, %s)), %d) AS value FROM %s.%s WHERE %s",
+			quoteString(prefix), labels, len(prefix)+1, r.conf.ChDB, table, where)
+	}))
+}
+
+// Series returns the label sets of the series of tenant matching any of the
+// selectors.
+func (r *p2cReader) Series(ctx context.Context, tenant string, selectors [][]*remote.LabelMatcher, start, end time.Time) ([][]*remote.LabelPair, error) {
+	tables, labels, where := r.metadataWhere(tenant, selectors, start, end)
+	if len(tables) == 0 {
+		return nil, nil
+	}
+	query := fmt.Sprintf("SELECT DISTINCT %s FROM (%s)", labels, unionSQL(tables, func(table string) string {
+		return fmt.Sprintf("SELECT %s FROM %s.%s WHERE %s", labels, r.conf.ChDB, table, where)
+	}))
+	release, err := r.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	rows, err := r.db.DB().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var series [][]*remote.LabelPair
+	for rows.Next() {
+		var tags []string
+		if err = rows.Scan(&tags); err != nil {
+			return nil, err
+		}
+		series = append(series, tagsToLabels(tags))
+	}
+	return series, rows.Err()
+}
+
+// metadataSQL returns the sorted distinct values of column of the query of
+// every table, or "" without tables.
+func metadataSQL(column string, tables []string, query func(table string) string) string {
+	if len(tables) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("SELECT DISTINCT %s FROM (%s) ORDER BY %s", column, unionSQL(tables, query), column)
+}
+
+type metadataEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// metadataCache keeps metadata results for a short while, dashboards load
+// the same label values over and over.
+type metadataCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]metadataEntry
+
+	requests *prometheus.CounterVec
+}
+
+func newMetadataCache(ttl time.Duration) *metadataCache {
+	c := &metadataCache{
+		ttl:     ttl,
+		entries: make(map[string]metadataEntry),
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "metadata_cache_requests_total",
+				Help: "Total number of label and series lookups, by whether they were answered from the cache.",
+			},
+			[]string{"result"},
+		),
+	}
+	prometheus.MustRegister(c.requests)
+	return c
+}
+
+// get returns the cached value of key, calling fetch if there is none.
+// Errors are not cached.
+func (c *metadataCache) get(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	if c.ttl <= 0 {
+		return fetch()
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		c.requests.WithLabelValues("hit").Inc()
+		return e.value, nil
+	}
+	c.requests.WithLabelValues("miss").Inc()
+
+	value, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= metadataCacheMax {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= metadataCacheMax {
+			c.entries = make(map[string]metadataEntry)
+		}
+	}
+	c.entries[key] = metadataEntry{value: value, expires: now.Add(c.ttl)}
+	return value, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+
+	cfg "github.com/prom2click/config"
+	"github.com/prom2click/schema"
+)
+
+// schemaOptions returns how the managed tables are laid out in clickhouse.
+func schemaOptions(conf *config) schema.Options {
+	return schema.Options{
+		Database:    conf.ChDB,
+		Cluster:     conf.SchemaCluster,
+		Replicated:  conf.SchemaReplicated,
+		ZKPath:      conf.SchemaZKPath,
+		Replica:     conf.SchemaReplica,
+		Distributed: conf.SchemaDistributed,
+		LocalSuffix: conf.SchemaLocalSuffix,
+	}
+}
+
+// managedTables returns every table prom2click writes to: one per distinct
+// table in the job config, plus the fallback table. The config has been
+// validated, so jobs sharing a table agree on its retention.
+func managedTables(conf *config, jobs []cfg.Job) []schema.Table {
+	var tables []schema.Table
+	seen := make(map[string]bool)
+	add := func(name string, retention schema.Retention) {
+		if name == "" || seen[name] {
+			return
+		}
+		seen[name] = true
+		tables = append(tables, conf.spec.Tables(name, retention)...)
+	}
+	for _, j := range jobs {
+		raw, rollup, _ := j.Retentions()
+		add(j.Table, schema.Retention{Raw: raw, Rollup: rollup})
+	}
+	if conf.WriteUnrouted == unroutedFallback {
+		add(conf.FallbackTable, schema.Retention{})
+	}
+	return tables
+}
+
+// initStatements are the statements `schema init` runs to create the
+// database and tables, in order. schema.sql is made of them.
+func initStatements(opts schema.Options, tables []schema.Table) []string {
+	stmts := []string{opts.CreateDatabase()}
+	for _, t := range tables {
+		stmts = append(stmts, opts.Create(t)...)
+	}
+	return stmts
+}
+
+// schemaCommand implements `schema init|diff|migrate`:
+//   init    creates the database and every missing table
+//   diff    shows how the live tables differ from what prom2click expects
+//   migrate shows the diff and then alters the tables to match
+// With -schema.dry-run the statements are only printed. It returns the process
+// exit code, for diff that is 1 if any table differs.
+func schemaCommand(conf *config, action string) int {
+	if action != "init" && action != "diff" && action != "migrate" {
+		fmt.Println("Error: usage: prom2click [flags] schema init|diff|migrate")
+		return 1
+	}
+
+	opts := schemaOptions(conf)
+	if opts.Distributed && opts.Cluster == "" {
+		fmt.Println("Error: schema.distributed requires schema.cluster")
+		return 1
+	}
+
+	// the tables may not exist yet, so only the static checks apply
+	config, err := cfg.NewConfigManager().Read()
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return 1
+	}
+	tables := managedTables(conf, config.Jobs)
+
+	checker, err := newSchemaChecker(conf)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return 1
+	}
+
+	exec := func(stmt string) bool {
+		fmt.Printf("%s;\n\n", stmt)
+		if conf.SchemaDryRun {
+			return true
+		}
+		if err := checker.Exec(stmt); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return false
+		}
+		return true
+	}
+
+	if action == "init" {
+		for _, stmt := range initStatements(opts, tables) {
+			if !exec(stmt) {
+				return 1
+			}
+		}
+		return 0
+	}
+
+	excode := 0
+	for _, t := range tables {
+		for _, name := range opts.Physical(t) {
+			d, err := checker.Diff(name, t.Columns)
+			// the data and so the TTL lives in the local table
+			if err == nil && name == opts.LocalName(t) {
+				err = checker.DiffTTL(&d, t.TTL)
+			}
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				return 1
+			}
+			fmt.Printf("-- %s\n", d)
+			if d.Empty() {
+				continue
+			}
+			if d.Missing {
+				fmt.Println("-- run `schema init` to create it")
+				excode = 1
+				continue
+			}
+			stmts := opts.Alter(d)
+			if action == "diff" {
+				for _, stmt := range stmts {
+					fmt.Printf("%s;\n", stmt)
+				}
+				excode = 1
+				continue
+			}
+			for _, stmt := range stmts {
+				if !exec(stmt) {
+					return 1
+				}
+			}
+		}
+	}
+	return excode
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/prom2click/schema"
+)
+
+// schemaSQLSections are the examples of schema.sql, each the dry-run output
+// of `schema init` for the flags in its comment and a job table "samples".
+var schemaSQLSections = []struct {
+	comment []string
+	opts    schema.Options
+	spec    schema.Spec
+}{
+	{
+		comment: []string{"single server"},
+		opts:    schema.Options{Database: "metrics"},
+		spec:    schema.Spec{Layout: schema.LayoutWide},
+	},
+	{
+		comment: []string{
+			"replicated and distributed over a cluster:",
+			"prom2click -schema.cluster=metrics -schema.replicated -schema.distributed schema init",
+		},
+		opts: schema.Options{
+			Database:    "metrics",
+			Cluster:     "metrics",
+			Replicated:  true,
+			ZKPath:      "/clickhouse/tables/{shard}/%s",
+			Replica:     "{replica}",
+			Distributed: true,
+			LocalSuffix: "_local",
+		},
+		spec: schema.Spec{Layout: schema.LayoutWide},
+	},
+	{
+		comment: []string{
+			"single server with rollups, staleness markers are left out of them:",
+			"prom2click -ch.rollups=1m,1h schema init",
+		},
+		opts: schema.Options{Database: "metrics"},
+		spec: schema.Spec{
+			Layout:   schema.LayoutWide,
+			Rollups:  []schema.Rollup{{Name: "1m", Resolution: time.Minute}, {Name: "1h", Resolution: time.Hour}},
+			Quantile: 0.75,
+		},
+	},
+}
+
+// schemaSQL renders schema.sql.
+func schemaSQL() []byte {
+	var b bytes.Buffer
+	b.WriteString("-- Generated by `prom2click schema init -schema.dry-run`, prefer running the\n")
+	b.WriteString("-- schema command against your own job config over editing this file.\n")
+	for i, s := range schemaSQLSections {
+		if i == 0 {
+			b.WriteString("--\n")
+		}
+		for _, line := range s.comment {
+			fmt.Fprintf(&b, "-- %s\n", line)
+		}
+		for _, stmt := range initStatements(s.opts, s.spec.Tables("samples", schema.Retention{})) {
+			fmt.Fprintf(&b, "%s;\n\n", stmt)
+		}
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
+
+// schema.sql must be what `schema init` creates, or tables made from it fail
+// the checks on startup
+func TestSchemaSQL(t *testing.T) {
+	got := schemaSQL()
+	if *update {
+		if err := ioutil.WriteFile("schema.sql", got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("schema.sql differs from the schema init dry-run, run go test -update -run TestSchemaSQL and review the diff:\n%s", got)
+	}
+}
@@ -0,0 +1,24 @@
+package protocal
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/cespare/xxhash"
+)
+
+// Fingerprint identifies a series of a tenant by its "name=value" tags,
+// independent of their order. Without tenant it only depends on the tags.
+func Fingerprint(tenant string, tags []string) uint64 {
+	sorted := tags
+	if !sort.StringsAreSorted(tags) {
+		sorted = make([]string, len(tags))
+		copy(sorted, tags)
+		sort.Strings(sorted)
+	}
+	key := strings.Join(sorted, "\xff")
+	if tenant != "" {
+		key = tenant + "\xfe" + key
+	}
+	return xxhash.Sum64([]byte(key))
+}
@@ -15,6 +15,12 @@ type K8sRequest struct {
 	Val           float64
 	Ts            time.Time
 	Tags          []string
+	// Tenant the series belongs to, empty unless tenants are enabled
+	Tenant string
+	// Fingerprint of Tenant and Tags, only set for the split series/samples layout
+	Fingerprint uint64
+	// Stale is 1 when Val is a staleness marker
+	Stale uint8
 }
 
 
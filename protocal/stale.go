@@ -0,0 +1,18 @@
+package protocal
+
+import "math"
+
+// StaleNaN is the bit pattern of the NaN prometheus writes as the last
+// sample of a series that disappeared, a staleness marker. It is different
+// from the NaN of math.NaN and of float arithmetic.
+const StaleNaN uint64 = 0x7ff0000000000002
+
+// IsStaleNaN reports whether v is a staleness marker.
+func IsStaleNaN(v float64) bool {
+	return math.Float64bits(v) == StaleNaN
+}
+
+// StaleValue returns a staleness marker.
+func StaleValue() float64 {
+	return math.Float64frombits(StaleNaN)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prom2click/schema"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// The query API pushes aggregations and rate/increase down to clickhouse.
+// Pushdown returns what the engine returns for the expressions pushdownExpr
+// translates, evaluated over the same samples: the steps of -ch.minperiod
+// the querier reads. Rather than reading every step, the steps each
+// evaluation time k of a series s selects are picked in one query of the
+// shape
+//
+//	SELECT s, k, <the value, or the rate inputs> FROM (<the querier's steps>) GROUP BY s, k
+//
+// and the rate extrapolation and the aggregation by groups are done here,
+// like the engine does them. In the split layout the series are resolved
+// against the series table first.
+
+// expr is an expression Pushdown can evaluate: an *aggregation or
+// *rangeFunction.
+type expr interface{}
+
+// vectorSelector is the selector aggregated by an aggregation.
+type vectorSelector struct {
+	matchers []*remote.LabelMatcher
+}
+
+// rangeFunction is rate or increase of a range selector, eg.
+// rate(http_requests_total[5m]).
+type rangeFunction struct {
+	fn       string
+	selector *vectorSelector
+	rng      time.Duration
+}
+
+// aggregation is sum, avg, min, max or count of a vector selector or range
+// function, grouped by or without labels.
+type aggregation struct {
+	op       string
+	grouping []string
+	without  bool
+	inner    expr
+}
+
+var rangeFunctions = map[string]bool{"rate": true, "increase": true}
+
+// errNoPushdown is returned by Pushdown for expressions it cannot evaluate
+// at the requested steps, they are left to the engine.
+var errNoPushdown = errors.New("expression cannot be pushed down")
+
+// pushdownExpr translates the parsed query e into the expression Pushdown
+// evaluates, if it has one of the shapes that can be pushed down. Selectors
+// with an offset are left to the engine.
+func pushdownExpr(e promql.Expr) (expr, bool) {
+	switch e := e.(type) {
+	case *promql.ParenExpr:
+		return pushdownExpr(e.Expr)
+
+	case *promql.Call:
+		if !rangeFunctions[e.Func.Name] {
+			return nil, false
+		}
+		sel, ok := e.Args[0].(*promql.MatrixSelector)
+		if !ok || sel.Offset != 0 {
+			return nil, false
+		}
+		return &rangeFunction{
+			fn:       e.Func.Name,
+			selector: &vectorSelector{matchers: toRemoteMatchers(sel.LabelMatchers)},
+			rng:      sel.Range,
+		}, true
+
+	case *promql.AggregateExpr:
+		op := e.Op.String()
+		if !aggregationOps[op] || e.Param != nil || e.KeepCommonLabels {
+			return nil, false
+		}
+		a := &aggregation{op: op, without: e.Without}
+		for _, l := range e.Grouping {
+			a.grouping = append(a.grouping, string(l))
+		}
+		inner := e.Expr
+		for {
+			p, ok := inner.(*promql.ParenExpr)
+			if !ok {
+				break
+			}
+			inner = p.Expr
+		}
+		if sel, ok := inner.(*promql.VectorSelector); ok {
+			if sel.Offset != 0 {
+				return nil, false
+			}
+			a.inner = &vectorSelector{matchers: toRemoteMatchers(sel.LabelMatchers)}
+			return a, true
+		}
+		f, ok := pushdownExpr(inner)
+		if a.inner, ok = f.(*rangeFunction); !ok {
+			return nil, false
+		}
+		return a, true
+	}
+	return nil, false
+}
+
+// aggregationOps are the PromQL aggregation operators Pushdown evaluates.
+var aggregationOps = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+// group returns the labels of the group of the series m, like the engine:
+// the grouping labels m has with by, all others but the metric name with
+// without.
+func (a *aggregation) group(m model.Metric) model.Metric {
+	g := model.Metric{}
+	if a.without {
+		for name, value := range m {
+			g[name] = value
+		}
+		delete(g, model.MetricNameLabel)
+		for _, l := range a.grouping {
+			delete(g, model.LabelName(l))
+		}
+		return g
+	}
+	for _, l := range a.grouping {
+		if value, ok := m[model.LabelName(l)]; ok {
+			g[model.LabelName(l)] = value
+		}
+	}
+	return g
+}
+
+// pushdownAcc is the value of a group at an evaluation time.
+type pushdownAcc struct {
+	value float64
+	count int
+}
+
+// add aggregates v into the value of the group like the engine, a min or max
+// replacing NaN.
+func (acc *pushdownAcc) add(op string, v float64) {
+	acc.count++
+	if acc.count == 1 {
+		acc.value = v
+		return
+	}
+	switch op {
+	case "sum", "avg":
+		acc.value += v
+	case "max":
+		if acc.value < v || math.IsNaN(acc.value) {
+			acc.value = v
+		}
+	case "min":
+		if acc.value > v || math.IsNaN(acc.value) {
+			acc.value = v
+		}
+	}
+}
+
+func (acc *pushdownAcc) result(op string) float64 {
+	switch op {
+	case "avg":
+		return acc.value / float64(acc.count)
+	case "count":
+		return float64(acc.count)
+	}
+	return acc.value
+}
+
+// Pushdown evaluates an aggregation or range function at start + k*step up
+// to end, or at end only if step is 0, and returns what the engine returns
+// for it. Steps and ranges that aren't whole milliseconds are left to the
+// engine with errNoPushdown.
+func (r *p2cReader) Pushdown(ctx context.Context, tenant string, e expr, start, end time.Time, step time.Duration) (model.Matrix, error) {
+	agg, _ := e.(*aggregation)
+	inner := e
+	if agg != nil {
+		inner = agg.inner
+	}
+	var sel *vectorSelector
+	var fn *rangeFunction
+	// how far back from an evaluation time samples are selected
+	lookback := promql.StalenessDelta
+	switch inner := inner.(type) {
+	case *vectorSelector:
+		sel = inner
+	case *rangeFunction:
+		if inner.rng <= 0 || inner.rng%time.Millisecond != 0 {
+			return nil, errNoPushdown
+		}
+		sel, fn, lookback = inner.selector, inner, inner.rng
+	default:
+		return nil, errNoPushdown
+	}
+	if step < 0 || step%time.Millisecond != 0 {
+		return nil, errNoPushdown
+	}
+
+	// the evaluation times of the engine, in milliseconds
+	first := model.TimeFromUnixNano(start.UnixNano())
+	interval, points := int64(1), int64(0)
+	if step > 0 {
+		interval, points = int64(step/time.Millisecond), int64(end.Sub(start)/step)
+	}
+
+	// the query the querier runs for the selector
+	q := &remote.Query{
+		StartTimestampMs: int64(first.Add(-lookback)),
+		EndTimestampMs:   int64(model.TimeFromUnixNano(end.UnixNano())),
+		Matchers:         sel.matchers,
+	}
+	if err := r.checkQuery(q.Matchers, start.Add(-lookback), end); err != nil {
+		return nil, err
+	}
+	tables := r.readTables(q.Matchers)
+	if len(tables) == 0 {
+		return model.Matrix{}, nil
+	}
+
+	release, err := r.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	split := schema.Layout(r.conf.ChLayout) == schema.LayoutSplit
+	var samples, series string
+	var metrics map[uint64]model.Metric
+	if split {
+		metrics = make(map[uint64]model.Metric)
+		var fps []string
+		err := r.lookupSeries(ctx, tenant, tables, q.Matchers, func(fp uint64, tags []string) {
+			metrics[fp] = toMetric(tagsToLabels(tags))
+			fps = append(fps, strconv.FormatUint(fp, 10))
+		})
+		if err != nil {
+			return nil, chLimitError(err)
+		}
+		if len(fps) == 0 {
+			return model.Matrix{}, nil
+		}
+		samples, err = r.splitSamplesSQL(q, int64(r.conf.CHMinPeriod), tables, fps)
+		if err != nil {
+			return nil, err
+		}
+		series = "fingerprint"
+	} else {
+		samples, err = r.samplesSQL(tenant, q, int64(r.conf.CHMinPeriod), tables)
+		if err != nil {
+			return nil, err
+		}
+		series = "tags"
+	}
+	sql := pushdownSQL(fn, samples, series, int64(first), interval, points, int64(lookback/time.Millisecond)) + r.settingsSQL()
+
+	rows, err := r.db.DB().QueryContext(ctx, sql)
+	if err != nil {
+		return nil, chLimitError(err)
+	}
+	defer rows.Close()
+
+	// the values of the groups by group and evaluation time, or the
+	// values of the series without an aggregation
+	type group struct {
+		metric model.Metric
+		accs   map[uint64]*pushdownAcc
+		stream *model.SampleStream
+	}
+	groups := make(map[model.Fingerprint]*group)
+	matrix := model.Matrix{}
+	n := 0
+	var lastTags []string
+	var lastMetric model.Metric
+	for rows.Next() {
+		var tags []string
+		var fp, k uint64
+		var v float64
+		s := interface{}(&tags)
+		if split {
+			s = &fp
+		}
+		if fn == nil {
+			err = rows.Scan(s, &k, &v)
+		} else {
+			var count, firstMs, lastMs uint64
+			var firstValue, lastValue, correction float64
+			err = rows.Scan(s, &k, &count, &firstMs, &firstValue, &lastMs, &lastValue, &correction)
+			v = fn.extrapolatedRate(first.Add(time.Duration(int64(k)*interval)*time.Millisecond), int(count),
+				model.SamplePair{Timestamp: model.Time(firstMs), Value: model.SampleValue(firstValue)},
+				model.SamplePair{Timestamp: model.Time(lastMs), Value: model.SampleValue(lastValue)},
+				correction)
+		}
+		if err != nil {
+			return nil, chLimitError(err)
+		}
+		n++
+
+		var m model.Metric
+		if split {
+			if m = metrics[fp]; m == nil {
+				continue
+			}
+		} else {
+			// the rows of a series mostly come in a row
+			if lastMetric == nil || !equalTags(tags, lastTags) {
+				lastTags, lastMetric = tags, toMetric(tagsToLabels(tags))
+			}
+			m = lastMetric
+		}
+		if fn != nil {
+			// like prometheus, rate and increase drop the metric name
+			m = m.Clone()
+			delete(m, model.MetricNameLabel)
+		}
+		if agg != nil {
+			m = agg.group(m)
+		}
+
+		g, ok := groups[m.Fingerprint()]
+		if !ok {
+			g = &group{metric: m, accs: make(map[uint64]*pushdownAcc)}
+			g.stream = &model.SampleStream{Metric: m}
+			groups[m.Fingerprint()] = g
+			matrix = append(matrix, g.stream)
+		}
+		if err = r.checkResult(len(matrix), n); err != nil {
+			return nil, err
+		}
+		if agg == nil {
+			g.stream.Values = append(g.stream.Values, model.SamplePair{
+				Timestamp: first.Add(time.Duration(int64(k)*interval) * time.Millisecond),
+				Value:     model.SampleValue(v),
+			})
+			continue
+		}
+		acc, ok := g.accs[k]
+		if !ok {
+			acc = &pushdownAcc{}
+			g.accs[k] = acc
+		}
+		acc.add(agg.op, v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, chLimitError(err)
+	}
+
+	for _, g := range groups {
+		if agg != nil {
+			for k, acc := range g.accs {
+				g.stream.Values = append(g.stream.Values, model.SamplePair{
+					Timestamp: first.Add(time.Duration(int64(k)*interval) * time.Millisecond),
+					Value:     model.SampleValue(acc.result(agg.op)),
+				})
+			}
+		}
+		sort.SliceStable(g.stream.Values, func(i, j int) bool {
+			return g.stream.Values[i].Timestamp < g.stream.Values[j].Timestamp
+		})
+	}
+	sort.Sort(matrix)
+	return matrix, nil
+}
+
+// equalTags reports whether a and b are the same tags in the same order.
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pushdownSQL returns the query selecting the steps of the querier's query
+// samples (see samplesSQL) per series and evaluation time first + k*interval,
+// k from 0 to points, all in milliseconds. A step at t is selected by the
+// evaluation times in [t, t+lookback], which select the steps of the
+// lookback before them like the engine: a vector selector the latest one,
+// unless the series went stale in it, rows s, k, v; a range function the
+// samples of the range ordered by time, rows s, k and their count, the
+// first and last time and value and the counter resets, if at least two.
+func pushdownSQL(fn *rangeFunction, samples, series string, first, interval, points, lookback int64) string {
+	// the first and one past the last evaluation time selecting a step,
+	// rounded towards the steps
+	lo := fmt.Sprintf("intDiv(greatest(toInt64(t) - %d + %d, 0), %d)", first, interval-1, interval)
+	hi := fmt.Sprintf("least(intDiv(greatest(toInt64(t) + %d - %d + %d, 0), %d), %d)", lookback, first, interval, interval, points+1)
+	where := "hi > lo"
+	if fn != nil {
+		// staleness markers are no samples of the range
+		where += " AND stale = 0"
+	}
+	fanout := fmt.Sprintf("SELECT s, t, value, stale, arrayJoin(arrayMap(i -> lo + i, range(hi - lo))) AS k FROM "+
+		"(SELECT %s AS s, t, value, stale, toUInt64(%s) AS lo, toUInt64(%s) AS hi FROM (%s) WHERE %s)",
+		series, lo, hi, samples, where)
+
+	if fn == nil {
+		return fmt.Sprintf("SELECT s, k, argMax(value, t) AS v FROM (%s) GROUP BY s, k HAVING argMax(stale, t) = 0", fanout)
+	}
+	// a counter reset adds the value before it, like prometheus
+	return fmt.Sprintf("SELECT s, k, n, ts[1], vs[1], ts[-1], vs[-1], "+
+		"arraySum(arrayMap((x, y) -> if(y < x, x, 0), arrayPopBack(vs), arrayPopFront(vs))) "+
+		"FROM (SELECT s, k, count() AS n, arraySort(groupArray(t)) AS ts, arraySort((x, y) -> y, groupArray(value), groupArray(t)) AS vs "+
+		"FROM (%s) GROUP BY s, k HAVING n >= 2)", fanout)
+}
+
+// extrapolatedRate returns rate or increase at t of the count samples of the
+// range from first to last with the counter resets correction, extrapolated
+// to the range like prometheus does.
+func (f *rangeFunction) extrapolatedRate(t model.Time, count int, first, last model.SamplePair, correction float64) float64 {
+	result := last.Value - first.Value + model.SampleValue(correction)
+
+	// duration between the first/last samples and the boundaries of the range
+	durationToStart := first.Timestamp.Sub(t.Add(-f.rng)).Seconds()
+	durationToEnd := t.Sub(last.Timestamp).Seconds()
+	sampledInterval := last.Timestamp.Sub(first.Timestamp).Seconds()
+	averageDurationBetweenSamples := sampledInterval / float64(count-1)
+
+	// counters cannot be negative, the zero point of the counter ends the
+	// extrapolation to the start
+	if result > 0 && first.Value >= 0 {
+		durationToZero := sampledInterval * float64(first.Value/result)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+	extrapolateToInterval := sampledInterval
+	if durationToStart < extrapolationThreshold {
+		extrapolateToInterval += durationToStart
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+	if durationToEnd < extrapolationThreshold {
+		extrapolateToInterval += durationToEnd
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+	result = result * model.SampleValue(extrapolateToInterval/sampledInterval)
+	if f.fn == "rate" {
+		result = result / model.SampleValue(f.rng.Seconds())
+	}
+	return float64(result)
+}
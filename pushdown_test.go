@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// ranges and steps the evaluation times can't be computed in milliseconds
+// with are left to the engine
+func TestPushdownRefusesSubMillisecond(t *testing.T) {
+	r := &p2cReader{conf: &config{}}
+	end := time.Unix(1500000000, 0)
+	for _, c := range []struct {
+		rng, step time.Duration
+	}{
+		{rng: 1500 * time.Microsecond, step: time.Minute},
+		{rng: time.Minute, step: 1500 * time.Microsecond},
+		{rng: 500 * time.Microsecond, step: 0},
+	} {
+		f := &rangeFunction{fn: "rate", selector: &vectorSelector{}, rng: c.rng}
+		for _, e := range []expr{f, &aggregation{op: "sum", inner: f}} {
+			if _, err := r.Pushdown(context.Background(), "", e, end.Add(-24*time.Hour), end, c.step); err != errNoPushdown {
+				t.Errorf("range %s, step %s: got error %v, want errNoPushdown", c.rng, c.step, err)
+			}
+		}
+	}
+}
+
+// pushdownStep is a step of -ch.minperiod of a series as the querier reads
+// it, at t milliseconds.
+type pushdownStep struct {
+	t     int64
+	value float64
+	stale bool
+}
+
+type pushdownSeries struct {
+	tags  []string
+	steps []pushdownStep
+}
+
+// pushdownData are counters and gauges in steps of 10s with a counter reset,
+// a gap, a staleness marker and a NaN.
+func pushdownData() []pushdownSeries {
+	var data []pushdownSeries
+	a1 := pushdownSeries{tags: []string{"__name__=x", "instance=1", "job=a"}}
+	v := 0.0
+	for t := int64(900); t <= 1300; t += 10 {
+		v += 5
+		if t == 1100 {
+			v = 2
+		}
+		a1.steps = append(a1.steps, pushdownStep{t: t * 1000, value: v})
+	}
+	a2 := pushdownSeries{tags: []string{"__name__=x", "instance=2", "job=a"}}
+	for t := int64(900); t <= 1300; t += 10 {
+		if t >= 1050 && t <= 1150 {
+			continue
+		}
+		a2.steps = append(a2.steps, pushdownStep{t: t * 1000, value: float64(t-900) * 0.3})
+	}
+	b1 := pushdownSeries{tags: []string{"__name__=x", "instance=1", "job=b"}}
+	for t := int64(900); t <= 1300; t += 10 {
+		s := pushdownStep{t: t * 1000, value: float64(t % 70)}
+		switch {
+		case t == 1000:
+			s.value = math.NaN()
+		case t == 1200:
+			s.stale = true
+		case t > 1200 && t < 1260:
+			continue
+		}
+		b1.steps = append(b1.steps, s)
+	}
+	return append(data, b1, a1, a2)
+}
+
+// the querier's query of the samples in the time range of query, or the
+// pushdown query, answered from data like clickhouse would
+type pushdownFake struct {
+	data []pushdownSeries
+	// the evaluation times of the pushdown query
+	first, interval, points, lookback int64
+	fn                                *rangeFunction
+}
+
+var fakeTimeRange = regexp.MustCompile(`ts >= toDateTime\((\d+)\) AND ts <= toDateTime\((\d+)\)`)
+
+func (f *pushdownFake) handle(query string) ([]string, [][]driver.Value, error) {
+	m := fakeTimeRange.FindStringSubmatch(query)
+	if m == nil {
+		return nil, nil, fmt.Errorf("no time range in %s", query)
+	}
+	from, _ := strconv.ParseInt(m[1], 10, 64)
+	to, _ := strconv.ParseInt(m[2], 10, 64)
+	// the steps the where clause selects samples of
+	steps := func(s pushdownSeries) []pushdownStep {
+		var in []pushdownStep
+		for _, st := range s.steps {
+			if st.t >= from/10*10*1000 && st.t <= to*1000 {
+				in = append(in, st)
+			}
+		}
+		return in
+	}
+
+	var rows [][]driver.Value
+	if !strings.Contains(query, "arrayJoin(") {
+		for _, s := range f.data {
+			for _, st := range steps(s) {
+				stale := uint8(0)
+				if st.stale {
+					stale = 1
+				}
+				rows = append(rows, []driver.Value{uint64(1), uint64(st.t), s.tags, st.value, stale})
+			}
+		}
+		return []string{"CNT", "t", "tags", "value", "stale"}, rows, nil
+	}
+
+	for _, s := range f.data {
+		in := steps(s)
+		for k := int64(0); k <= f.points; k++ {
+			at := f.first + k*f.interval
+			var window []pushdownStep
+			for _, st := range in {
+				if st.t >= at-f.lookback && st.t <= at && (f.fn == nil || !st.stale) {
+					window = append(window, st)
+				}
+			}
+			if f.fn == nil {
+				if len(window) > 0 && !window[len(window)-1].stale {
+					rows = append(rows, []driver.Value{s.tags, uint64(k), window[len(window)-1].value})
+				}
+				continue
+			}
+			if len(window) < 2 {
+				continue
+			}
+			correction := 0.0
+			for i := 1; i < len(window); i++ {
+				if window[i].value < window[i-1].value {
+					correction += window[i-1].value
+				}
+			}
+			last := window[len(window)-1]
+			rows = append(rows, []driver.Value{s.tags, uint64(k), uint64(len(window)),
+				uint64(window[0].t), window[0].value, uint64(last.t), last.value, correction})
+		}
+	}
+	if f.fn == nil {
+		return []string{"s", "k", "v"}, rows, nil
+	}
+	return []string{"s", "k", "n", "ft", "fv", "lt", "lv", "c"}, rows, nil
+}
+
+func sameValue(a, b model.SampleValue) bool {
+	if math.IsNaN(float64(a)) || math.IsNaN(float64(b)) {
+		return math.IsNaN(float64(a)) && math.IsNaN(float64(b))
+	}
+	return math.Abs(float64(a-b)) <= 1e-9*math.Max(1, math.Abs(float64(a)))
+}
+
+// a pushed down query returns what the engine returns over the samples of
+// the querier
+func TestPushdownMatchesEngine(t *testing.T) {
+	fake := &pushdownFake{data: pushdownData()}
+	r := fakeReader(t, fake.handle)
+	engine := promql.NewEngine(p2cQueryable{reader: r}, nil)
+
+	queries := []string{
+		`rate(x[1m])`,
+		`increase(x[45s])`,
+		`sum(rate(x[1m]))`,
+		`sum by (job) (increase(x[90s]))`,
+		`max without (instance) (rate(x[30s]))`,
+		`avg(x)`,
+		`count by (job) (x)`,
+		`min by (instance) (x)`,
+		`max(x)`,
+		`sum without (job) (x)`,
+	}
+	ranges := []struct {
+		start, end time.Time
+		step       time.Duration
+	}{
+		{start: time.Unix(1003, 0), end: time.Unix(1297, 0), step: 17 * time.Second},
+		{start: time.Unix(1000, 0), end: time.Unix(1300, 0), step: 10 * time.Second},
+		{start: time.Unix(1150, 500*1e6), end: time.Unix(1250, 0), step: 2500 * time.Millisecond},
+		// instant queries
+		{start: time.Unix(1150, 0), end: time.Unix(1150, 0)},
+		{start: time.Unix(1212, 250*1e6), end: time.Unix(1212, 250*1e6)},
+	}
+
+	for _, qs := range queries {
+		e, err := promql.ParseExpr(qs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pe, ok := pushdownExpr(e)
+		if !ok {
+			t.Fatalf("%s is not pushed down", qs)
+		}
+		for _, c := range ranges {
+			name := fmt.Sprintf("%s from %s to %s step %s", qs, c.start.UTC().Format("15:04:05.000"), c.end.UTC().Format("15:04:05.000"), c.step)
+
+			var want model.Matrix
+			if c.step == 0 {
+				q, err := engine.NewInstantQuery(qs, model.TimeFromUnixNano(c.start.UnixNano()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				vector, err := q.Exec(context.Background()).Vector()
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				for _, s := range vector {
+					want = append(want, &model.SampleStream{Metric: s.Metric, Values: []model.SamplePair{{Timestamp: s.Timestamp, Value: s.Value}}})
+				}
+				sort.Sort(want)
+			} else {
+				q, err := engine.NewRangeQuery(qs, model.TimeFromUnixNano(c.start.UnixNano()), model.TimeFromUnixNano(c.end.UnixNano()), c.step)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want, err = q.Exec(context.Background()).Matrix(); err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+			}
+
+			fake.first = int64(model.TimeFromUnixNano(c.start.UnixNano()))
+			fake.interval, fake.points = 1, 0
+			if c.step > 0 {
+				fake.interval, fake.points = int64(c.step/time.Millisecond), int64(c.end.Sub(c.start)/c.step)
+			}
+			fake.fn, _ = pe.(*rangeFunction)
+			if a, ok := pe.(*aggregation); ok {
+				fake.fn, _ = a.inner.(*rangeFunction)
+			}
+			fake.lookback = int64(promql.StalenessDelta / time.Millisecond)
+			if fake.fn != nil {
+				fake.lookback = int64(fake.fn.rng / time.Millisecond)
+			}
+			got, err := r.Pushdown(context.Background(), "", pe, c.start, c.end, c.step)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+
+			if len(want) == 0 {
+				t.Errorf("%s: the engine returns nothing, the case tests nothing", name)
+			}
+			if len(got) != len(want) {
+				t.Errorf("%s: got %d series, want %d:\n%s\nwant:\n%s", name, len(got), len(want), got, want)
+				continue
+			}
+			for i := range want {
+				same := got[i].Metric.Equal(want[i].Metric) && len(got[i].Values) == len(want[i].Values)
+				for j := 0; same && j < len(want[i].Values); j++ {
+					same = got[i].Values[j].Timestamp == want[i].Values[j].Timestamp &&
+						sameValue(got[i].Values[j].Value, want[i].Values[j].Value)
+				}
+				if !same {
+					t.Errorf("%s: got\n%s\nwant\n%s", name, got[i], want[i])
+				}
+			}
+		}
+	}
+}
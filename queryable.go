@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	pro "github.com/prom2click/protocal"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
+	"golang.org/x/net/context"
+)
+
+// The query API evaluates what Pushdown can't with the vendored prometheus
+// engine. The engine reads the samples of every selector of a query through
+// a querier, which runs them as remote read queries with a step of
+// -ch.minperiod.
+
+// tenantKey is the context key of the tenant whose series a query reads,
+// the engine passes the context of Exec on to the querier.
+type tenantKey struct{}
+
+// p2cQueryable opens the queriers of the engine.
+type p2cQueryable struct {
+	reader *p2cReader
+}
+
+func (q p2cQueryable) Querier() (local.Querier, error) {
+	return &p2cQuerier{reader: q.reader}, nil
+}
+
+// p2cQuerier implements local.Querier with the series of the tenant of the
+// query context.
+type p2cQuerier struct {
+	reader *p2cReader
+}
+
+func tenantOfContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// toRemoteMatchers converts the matchers of a parsed selector.
+func toRemoteMatchers(matchers metric.LabelMatchers) []*remote.LabelMatcher {
+	types := map[metric.MatchType]remote.MatchType{
+		metric.Equal:        remote.MatchType_EQUAL,
+		metric.NotEqual:     remote.MatchType_NOT_EQUAL,
+		metric.RegexMatch:   remote.MatchType_REGEX_MATCH,
+		metric.RegexNoMatch: remote.MatchType_REGEX_NO_MATCH,
+	}
+	ms := make([]*remote.LabelMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		ms = append(ms, &remote.LabelMatcher{Type: types[m.Type], Name: string(m.Name), Value: string(m.Value)})
+	}
+	return ms
+}
+
+func (q *p2cQuerier) QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	query := &remote.Query{
+		StartTimestampMs: int64(from),
+		EndTimestampMs:   int64(through),
+		Matchers:         toRemoteMatchers(matchers),
+	}
+	res, _, err := q.reader.Query(ctx, tenantOfContext(ctx), query, int64(q.reader.conf.CHMinPeriod))
+	if err != nil {
+		return nil, err
+	}
+	its := make([]local.SeriesIterator, 0, len(res.Timeseries))
+	for _, ts := range res.Timeseries {
+		it := &seriesIterator{
+			metric:  metric.Metric{Metric: toMetric(ts.Labels)},
+			samples: make([]model.SamplePair, 0, len(ts.Samples)),
+		}
+		for _, s := range ts.Samples {
+			it.samples = append(it.samples, model.SamplePair{Timestamp: model.Time(s.TimestampMs), Value: model.SampleValue(s.Value)})
+		}
+		its = append(its, it)
+	}
+	return its, nil
+}
+
+func (q *p2cQuerier) QueryInstant(ctx context.Context, ts model.Time, stalenessDelta time.Duration, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	return q.QueryRange(ctx, ts.Add(-stalenessDelta), ts, matchers...)
+}
+
+func (q *p2cQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	selectors := make([][]*remote.LabelMatcher, 0, len(matcherSets))
+	for _, ms := range matcherSets {
+		selectors = append(selectors, toRemoteMatchers(ms))
+	}
+	series, err := q.reader.Series(ctx, tenantOfContext(ctx), selectors, from.Time(), through.Time())
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]metric.Metric, 0, len(series))
+	for _, labels := range series {
+		metrics = append(metrics, metric.Metric{Metric: toMetric(labels)})
+	}
+	return metrics, nil
+}
+
+func (q *p2cQuerier) LastSampleForLabelMatchers(ctx context.Context, cutoff model.Time, matcherSets ...metric.LabelMatchers) (model.Vector, error) {
+	now := model.Now()
+	seen := make(map[model.Fingerprint]bool)
+	vector := model.Vector{}
+	for _, ms := range matcherSets {
+		its, err := q.QueryRange(ctx, cutoff, now, ms...)
+		if err != nil {
+			return nil, err
+		}
+		for _, it := range its {
+			m := it.Metric().Metric
+			last := it.ValueAtOrBeforeTime(now)
+			if seen[m.Fingerprint()] || last.Timestamp.Before(cutoff) {
+				continue
+			}
+			seen[m.Fingerprint()] = true
+			vector = append(vector, &model.Sample{Metric: m, Value: last.Value, Timestamp: last.Timestamp})
+		}
+	}
+	return vector, nil
+}
+
+// LabelValuesForLabelName returns the values of the last day, like the
+// label values API without start.
+func (q *p2cQuerier) LabelValuesForLabelName(ctx context.Context, name model.LabelName) (model.LabelValues, error) {
+	end := time.Now()
+	values, err := q.reader.LabelValues(ctx, tenantOfContext(ctx), string(name), nil, end.Add(-24*time.Hour), end)
+	if err != nil {
+		return nil, err
+	}
+	lvs := make(model.LabelValues, 0, len(values))
+	for _, v := range values {
+		lvs = append(lvs, model.LabelValue(v))
+	}
+	return lvs, nil
+}
+
+func (q *p2cQuerier) Close() error {
+	return nil
+}
+
+// seriesIterator iterates the samples of a series read from clickhouse,
+// ordered by time. Staleness markers end the series: they are never
+// returned and no sample is found at or after them until the next one.
+type seriesIterator struct {
+	metric  metric.Metric
+	samples []model.SamplePair
+}
+
+func (it *seriesIterator) ValueAtOrBeforeTime(t model.Time) model.SamplePair {
+	i := sort.Search(len(it.samples), func(i int) bool { return it.samples[i].Timestamp.After(t) })
+	if i == 0 || pro.IsStaleNaN(float64(it.samples[i-1].Value)) {
+		return model.ZeroSamplePair
+	}
+	return it.samples[i-1]
+}
+
+func (it *seriesIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	i := sort.Search(len(it.samples), func(i int) bool { return !it.samples[i].Timestamp.Before(in.OldestInclusive) })
+	var values []model.SamplePair
+	for ; i < len(it.samples) && !it.samples[i].Timestamp.After(in.NewestInclusive); i++ {
+		if !pro.IsStaleNaN(float64(it.samples[i].Value)) {
+			values = append(values, it.samples[i])
+		}
+	}
+	return values
+}
+
+func (it *seriesIterator) Metric() metric.Metric {
+	return it.metric
+}
+
+func (it *seriesIterator) Close() {}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pro "github.com/prom2click/protocal"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+)
+
+// series with samples every 10s from 0s to 50s, gone stale at 30s
+func staleSeries(name string) *seriesIterator {
+	it := &seriesIterator{metric: metric.Metric{Metric: model.Metric{model.MetricNameLabel: model.LabelValue(name)}}}
+	for i := 0; i <= 5; i++ {
+		v := model.SampleValue(i)
+		if i == 3 {
+			v = model.SampleValue(pro.StaleValue())
+		}
+		it.samples = append(it.samples, model.SamplePair{Timestamp: model.Time(i * 10000), Value: v})
+	}
+	return it
+}
+
+func TestSeriesIteratorStaleness(t *testing.T) {
+	it := staleSeries("x")
+	for _, c := range []struct {
+		at   model.Time
+		want model.SamplePair
+	}{
+		{at: 25000, want: model.SamplePair{Timestamp: 20000, Value: 2}},
+		{at: 30000, want: model.ZeroSamplePair},
+		{at: 35000, want: model.ZeroSamplePair},
+		{at: 40000, want: model.SamplePair{Timestamp: 40000, Value: 4}},
+		{at: -1, want: model.ZeroSamplePair},
+	} {
+		if got := it.ValueAtOrBeforeTime(c.at); got != c.want {
+			t.Errorf("ValueAtOrBeforeTime(%v) = %v, want %v", c.at, got, c.want)
+		}
+	}
+
+	got := it.RangeValues(metric.Interval{OldestInclusive: 10000, NewestInclusive: 40000})
+	want := []model.SamplePair{{Timestamp: 10000, Value: 1}, {Timestamp: 20000, Value: 2}, {Timestamp: 40000, Value: 4}}
+	if len(got) != len(want) {
+		t.Fatalf("RangeValues = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("RangeValues = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPushdownExpr(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		want  string // type of the translated expression, "" if not pushed down
+	}{
+		{`rate(x[5m])`, "rate"},
+		{`(increase(x{job="a"}[1h]))`, "increase"},
+		{`sum by (code) (rate(x[5m]))`, "sum"},
+		{`avg without (instance) (x)`, "avg"},
+		{`count((x))`, "count"},
+		{`x`, ""},
+		{`x offset 5m`, ""},
+		{`sum(x offset 5m)`, ""},
+		{`rate(x[5m] offset 1h)`, ""},
+		{`topk(3, x)`, ""},
+		{`quantile(0.9, x)`, ""},
+		{`sum(irate(x[5m]))`, ""},
+		{`sum(x) / 2`, ""},
+		{`sum(sum(x))`, ""},
+		{`time()`, ""},
+		{`1 + 1`, ""},
+	} {
+		e, err := promql.ParseExpr(c.query)
+		if err != nil {
+			t.Fatalf("%s: %s", c.query, err)
+		}
+		got := ""
+		if pe, ok := pushdownExpr(e); ok {
+			switch pe := pe.(type) {
+			case *aggregation:
+				got = pe.op
+			case *rangeFunction:
+				got = pe.fn
+			}
+		}
+		if got != c.want {
+			t.Errorf("%s: pushed down as %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+type staticQueryable []local.SeriesIterator
+
+func (q staticQueryable) Querier() (local.Querier, error) { return q, nil }
+
+func (q staticQueryable) QueryRange(context.Context, model.Time, model.Time, ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	return q, nil
+}
+
+func (q staticQueryable) QueryInstant(context.Context, model.Time, time.Duration, ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	return q, nil
+}
+
+func (q staticQueryable) MetricsForLabelMatchers(context.Context, model.Time, model.Time, ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return nil, nil
+}
+
+func (q staticQueryable) LastSampleForLabelMatchers(context.Context, model.Time, ...metric.LabelMatchers) (model.Vector, error) {
+	return nil, nil
+}
+
+func (q staticQueryable) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func (q staticQueryable) Close() error { return nil }
+
+// the engine treats a staleness marker as the end of the series
+func TestEngineStaleness(t *testing.T) {
+	live := staleSeries("live")
+	live.samples[3].Value = 3
+	engine := promql.NewEngine(staticQueryable{staleSeries("stale"), live}, nil)
+
+	q, err := engine.NewRangeQuery(`{__name__=~".+"}`, 0, 50000, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix, err := q.Exec(context.Background()).Matrix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := map[model.LabelValue]int{}
+	for _, ss := range matrix {
+		points[ss.Metric[model.MetricNameLabel]] = len(ss.Values)
+	}
+	// 0s to 20s and 40s to 50s
+	if points["stale"] != 5 || points["live"] != 6 {
+		t.Errorf("points per series = %v, want stale: 5, live: 6", points)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// clickhouse error codes of queries exceeding the settings of settingsSQL
+const (
+	chTooManyRows        = 158
+	chTimeoutExceeded    = 159
+	chTooManyRowsOrBytes = 396
+)
+
+// queryLimitError is a read exceeding one of the -read.* limits. It is the
+// client's fault and answered with a 4xx, unlike other read errors.
+type queryLimitError struct {
+	msg string
+}
+
+func (e *queryLimitError) Error() string {
+	return e.msg
+}
+
+func limitErrorf(format string, args ...interface{}) error {
+	return &queryLimitError{msg: fmt.Sprintf(format, args...)}
+}
+
+// checkQuery rejects queries over more than -read.max-range or without an
+// equality matcher if -read.require-equality-matcher is set.
+func (r *p2cReader) checkQuery(matchers []*remote.LabelMatcher, start, end time.Time) error {
+	if max := r.conf.ReadMaxRange; max > 0 && end.Sub(start) > max {
+		return limitErrorf("query time range %s exceeds the limit of %s", end.Sub(start), max)
+	}
+	if !r.conf.ReadRequireEqualityMatcher {
+		return nil
+	}
+	for _, m := range matchers {
+		if m.Type == remote.MatchType_EQUAL && m.Value != "" {
+			return nil
+		}
+	}
+	return limitErrorf("queries need at least one equality matcher with a non-empty value, eg. {job=\"api\"}")
+}
+
+// checkResult fails once a query returned more than -read.max-series series
+// or -read.max-samples samples.
+func (r *p2cReader) checkResult(series, samples int) error {
+	if max := r.conf.ReadMaxSeries; max > 0 && series > max {
+		return limitErrorf("query returns more than the limit of %d series", max)
+	}
+	if max := r.conf.ReadMaxSamples; max > 0 && samples > max {
+		return limitErrorf("query returns more than the limit of %d samples", max)
+	}
+	return nil
+}
+
+// settingsSQL returns the SETTINGS clause making clickhouse abort read
+// queries scanning too much, or "" if unlimited.
+func (r *p2cReader) settingsSQL() string {
+	var settings []string
+	if r.conf.ReadMaxRowsToRead > 0 {
+		settings = append(settings, fmt.Sprintf("max_rows_to_read = %d", r.conf.ReadMaxRowsToRead))
+	}
+	if secs := int64(r.conf.ReadMaxExecutionTime / time.Second); secs > 0 {
+		settings = append(settings, fmt.Sprintf("max_execution_time = %d", secs))
+	}
+	if len(settings) == 0 {
+		return ""
+	}
+	return " SETTINGS " + strings.Join(settings, ", ")
+}
+
+// chLimitError turns the clickhouse errors of queries aborted by the
+// settings of settingsSQL into a queryLimitError.
+func chLimitError(err error) error {
+	if e, ok := err.(*clickhouse.Exception); ok {
+		switch e.Code {
+		case chTooManyRows, chTooManyRowsOrBytes:
+			return limitErrorf("query reads more rows than -read.max-rows-to-read allows: %s", e.Message)
+		case chTimeoutExceeded:
+			return limitErrorf("query runs longer than -read.max-execution-time: %s", e.Message)
+		}
+	}
+	return err
+}
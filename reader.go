@@ -1,27 +1,34 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
-	"strings"
-	tag "github.com/prom2click/label"
-	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/remote"
 	"time"
-	"reflect"
-	"bytes"
+	"sync"
+	"github.com/prom2click/database"
 	"github.com/prom2click/job"
+	pro "github.com/prom2click/protocal"
+	"github.com/prom2click/schema"
 )
 
 type p2cReader struct {
 	conf *config
-	db   *sql.DB
+	db   *database.Pool
 	jm   *job.JobManager
+	// inflight holds a token per clickhouse query running on behalf of any
+	// request, nil if unlimited
+	inflight chan struct{}
+	// results caches remote read results, nil if disabled
+	results *resultsCache
 }
 
-// getTimePeriod return select and where SQL chunks relating to the time period -or- error
-func (r *p2cReader) getTimePeriod(query *remote.Query) (string, string, error) {
+// getTimePeriod return select and where SQL chunks relating to the time period
+// and the rollup to read from (nil for the raw samples) -or- error. The
+// samples are aggregated over step seconds, or a step derived from
+// CHMaxSamples and CHMinPeriod if it is 0.
+func (r *p2cReader) getTimePeriod(query *remote.Query, step int64) (string, string, *schema.Rollup, error) {
 
 	var tselSQL = "SELECT COUNT() AS CNT, (intDiv(toUInt32(ts), %d) * %d) * 1000 as t"
 	var twhereSQL = "WHERE date >= toDate(%d) AND ts >= toDateTime(%d) AND ts <= toDateTime(%d)"
@@ -32,83 +39,128 @@ func (r *p2cReader) getTimePeriod(query *remote.Query) (string, string, error) {
 	// valid time period
 	if tend < tstart {
 		err = errors.New("Start time is after end time")
-		return "", "", err
+		return "", "", nil, err
 	}
 
-	// need time period in seconds
-	tperiod := tend - tstart
-
 	// need to split time period into <nsamples> - also, don't divide by zero
 	if r.conf.CHMaxSamples < 1 {
-		err = fmt.Errorf(fmt.Sprintf("Invalid CHMaxSamples: %d", r.conf.CHMaxSamples))
-		return "", "", err
+		err = fmt.Errorf("Invalid CHMaxSamples: %d", r.conf.CHMaxSamples)
+		return "", "", nil, err
 	}
-	taggr := tperiod / int64(r.conf.CHMaxSamples)
-	if taggr < int64(r.conf.CHMinPeriod) {
-		taggr = int64(r.conf.CHMinPeriod)
+	taggr := r.defaultStep(tstart, tend)
+	if step > 0 {
+		taggr = step
 	}
 
+	taggr, rollup := r.getStep(taggr)
+
 	selectSQL := fmt.Sprintf(tselSQL, taggr, taggr)
 	whereSQL := fmt.Sprintf(twhereSQL, tstart, tstart, tend)
 
-	return selectSQL, whereSQL, nil
+	return selectSQL, whereSQL, rollup, nil
 }
 
-//make the sql body ..
-func (r *p2cReader) getSQLOut(matchers []*remote.LabelMatcher) (sqlhead, sqlbody string) {
-
-	// join 为函数地址
-	f := func(m *remote.LabelMatcher, name string) (sqlr string) {
-
-		//tag.Namespace
-		switch m.Type {
-		case remote.MatchType_EQUAL:
-			sqlr = fmt.Sprintf(` %s='%s' `, name, strings.Replace(m.Value, `'`, `\'`, -1))
-		case remote.MatchType_NOT_EQUAL:
-			sqlr = fmt.Sprintf(` %s!='%s' `, name, strings.Replace(m.Value, `'`, `\'`, -1))
-		case remote.MatchType_REGEX_MATCH:
-			sqlr = fmt.Sprintf(` match(%s, %s) = 1 `, name, strings.Replace(m.Value, `/`, `\/`, -1))
-		case remote.MatchType_REGEX_NO_MATCH:
-			sqlr = fmt.Sprintf(` match(%s, %s) = 0 `, name, strings.Replace(m.Value, `/`, `\/`, -1))
-		}
-		return
-	}
-
-	mslicebody := []string{}
-	mslicehead := []string{}
-	for _, m := range matchers {
-
-		switch(m.Name) {
-		case tag.Namespace, tag.Keyspace, tag.Ip, tag.Shard, tag.App, tag.Component, tag.Container, tag.Job, model.MetricNameLabel:
-			{
-				if m.Name == model.MetricNameLabel {
-					m.Name = "name"
-				}
-				if m.Name == tag.Container {
-					m.Name = "containername"
-				}
-				mslicebody = append(mslicebody, f(m, m.Name))
-				mslicehead = append(mslicehead, m.Name)
-			}
-		default:
-			continue
+// defaultStep returns the step of a remote read between tstart and tend:
+// the time period split into CHMaxSamples, at least CHMinPeriod.
+func (r *p2cReader) defaultStep(tstart, tend int64) int64 {
+	taggr := (tend - tstart) / int64(r.conf.CHMaxSamples)
+	if taggr < int64(r.conf.CHMinPeriod) {
+		taggr = int64(r.conf.CHMinPeriod)
+	}
+	return taggr
+}
+
+// getStep returns the coarsest rollup whose buckets fit in step (nil for the
+// raw samples) and step rounded up so every step covers whole rollup buckets.
+func (r *p2cReader) getStep(step int64) (int64, *schema.Rollup) {
+	rollup := r.getRollup(step)
+	if rollup != nil {
+		res := rollup.Seconds()
+		step = (step + res - 1) / res * res
+	}
+	return step, rollup
+}
+
+// getRollup returns the coarsest rollup with a resolution of at most step
+// seconds, or nil if the raw samples have to be read.
+func (r *p2cReader) getRollup(step int64) *schema.Rollup {
+	var best *schema.Rollup
+	for i, rollup := range r.conf.spec.Rollups {
+		if rollup.Seconds() <= step {
+			best = &r.conf.spec.Rollups[i]
 		}
 	}
+	return best
+}
 
-	return strings.Join(mslicehead, ","), strings.Join(mslicebody, "and")
+// getSource returns the table to read the samples of table from, the
+// expression aggregating val over a step and the expression telling whether
+// the series went stale in the step: whether its last sample is a staleness
+// marker. The markers are left out of the aggregate, rollups don't hold any.
+func (r *p2cReader) getSource(table string, rollup *schema.Rollup) (string, string, string) {
+	if rollup == nil {
+		return table, fmt.Sprintf("quantileIf(%f)(val, stale = 0)", r.conf.CHQuantile), "argMax(stale, ts)"
+	}
+	return rollup.TableName(table), fmt.Sprintf("quantileMerge(%f)(val)", r.conf.CHQuantile), "toUInt8(0)"
+}
+
+// sampleValue returns the value of a step read from clickhouse, the
+// staleness marker when the series went stale in it.
+func sampleValue(value float64, stale uint8) float64 {
+	if stale != 0 {
+		return pro.StaleValue()
+	}
+	return value
+}
+
+// getSQL returns the query of the samples of tables matching query, one row
+// per series (tags) and step, ordered by series.
+func (r *p2cReader) getSQL(tenant string, query *remote.Query, step int64, tables []string) (string, error) {
+	sql, err := r.samplesSQL(tenant, query, step, tables)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) ORDER BY tags, t%s", sql, r.settingsSQL()), nil
 }
 
-func (r *p2cReader) getSQL(query *remote.Query) (string, error) {
+// samplesSQL returns the unordered query of getSQL, with the columns CNT, t
+// (the start of the step in milliseconds), tags, value and stale.
+func (r *p2cReader) samplesSQL(tenant string, query *remote.Query, step int64, tables []string) (string, error) {
 	// time related select sql, where sql chunks
-	tselectSQL, twhereSQL, err := r.getTimePeriod(query)
+	tselectSQL, twhereSQL, rollup, err := r.getTimePeriod(query, step)
 	if err != nil {
 		return "", err
 	}
-	head, body := r.getSQLOut(query.Matchers)
-	// put select and where together with group by etc
-	tempSQL := "%s,%s, quantile(%f)(val) as value FROM %s.%s %s and %s GROUP BY t,%s ORDER BY t asc"
-	sql := fmt.Sprintf(tempSQL, tselectSQL, head, r.conf.CHQuantile, r.conf.ChDB, r.conf.ChTable, twhereSQL, body, head)
-	return sql, nil
+	if r.conf.spec.Tenants {
+		// reads never see the series of other tenants
+		twhereSQL += " AND tenant = " + quoteString(tenant)
+	}
+	// the full label set is in tags, the promoted columns only hold some
+	// of the labels
+	for _, m := range query.Matchers {
+		twhereSQL += " AND " + seriesCondition(m, "tags")
+	}
+	return r.stepsSQL(tselectSQL, twhereSQL, rollup, "tags", tables), nil
+}
+
+// stepsSQL returns the query of one row per series and step of the samples
+// of tables matching twhereSQL, series being the column identifying them.
+// The samples of all tables are grouped together, so a series found in
+// several tables, eg. after its job moved to another table, still has a
+// single value per step.
+func (r *p2cReader) stepsSQL(tselectSQL, twhereSQL string, rollup *schema.Rollup, series string, tables []string) string {
+	columns := "ts, " + series + ", val"
+	if rollup == nil {
+		columns += ", stale"
+	}
+	samples := unionSQL(tables, func(t string) string {
+		table, _, _ := r.getSource(t, rollup)
+		return fmt.Sprintf("SELECT %s FROM %s.%s %s", columns, r.conf.ChDB, r.tableName(table), twhereSQL)
+	})
+	// the aggregates are the same for every table
+	_, value, stale := r.getSource("", rollup)
+	return fmt.Sprintf("%s, %s, %s AS value, %s AS stale FROM (%s) GROUP BY t, %s",
+		tselectSQL, series, value, stale, samples, series)
 }
 
 func NewP2CReader(conf *config, jm *job.JobManager) (*p2cReader, error) {
@@ -116,10 +168,15 @@ func NewP2CReader(conf *config, jm *job.JobManager) (*p2cReader, error) {
 	r := new(p2cReader)
 	r.conf = conf
 	r.jm = jm
-	r.db, err = sql.Open("clickhouse", r.conf.ChDSN)
-	r.db.SetMaxOpenConns(100)
-	r.db.SetMaxIdleConns(10)
-	r.db.Ping()
+	if conf.ReadMaxInflight > 0 {
+		r.inflight = make(chan struct{}, conf.ReadMaxInflight)
+	}
+	if conf.ReadCacheSize > 0 {
+		if r.results, err = newResultsCache(conf); err != nil {
+			return r, err
+		}
+	}
+	r.db, err = database.Open(r.conf.readDSN, 100, 10)
 	if err != nil {
 		fmt.Printf("Error connecting to clickhouse: %s\n", err.Error())
 		return r, err
@@ -128,135 +185,204 @@ func NewP2CReader(conf *config, jm *job.JobManager) (*p2cReader, error) {
 	return r, nil
 }
 
-func (r *p2cReader) Read(req *remote.ReadRequest) (*remote.ReadResponse, error) {
-	var err error
-	var sqlStr string
-	var rows *sql.Rows
-
-	resp := remote.ReadResponse{
-		Results: []*remote.QueryResult{
-			{Timeseries: make([]*remote.TimeSeries, 0, 0)},
-		},
-	}
-	// need to map tags to timeseries to record samples
-	var tsres = make(map[string]*remote.TimeSeries)
-
-	// for debugging/figuring out query format/etc
-	rcount := 0
+// Read answers a remote read request with the series of tenant, which is
+// ignored unless tenants are enabled. The queries of the request run
+// concurrently, with at most ReadConcurrency clickhouse queries at a time
+// including those of split queries; the first error cancels the others.
+func (r *p2cReader) Read(ctx context.Context, tenant string, req *remote.ReadRequest) (*remote.ReadResponse, error) {
+	results := make([]*remote.QueryResult, len(req.Queries))
+	counts := make([]int, len(req.Queries))
 
 	for _, q := range req.Queries {
-
 		tm1 := time.Unix(q.StartTimestampMs/1000, 0)
 		tm2 := time.Unix(q.EndTimestampMs/1000, 0)
 		// remove me..
 		fmt.Printf("\nquery: start: %s, end: %s\n\n", tm1.Format("2006-01-02 03:04:05 PM"), tm2.Format("2006-01-02 03:04:05 PM"))
 		fmt.Printf("\nsql comes from prometheus %s\n", q.String())
+	}
 
-		// get the select sql
-		sqlStr, err = r.getSQL(q)
-		fmt.Printf("query: running sql: %s\n\n", sqlStr)
-		if err != nil {
-			fmt.Printf("Error: reader: getSQL: %s\n", err.Error())
-			return &resp, err
-		}
-
-		// get the select sql
-		if err != nil {
-			fmt.Printf("Error: reader: getSQL: %s\n", err.Error())
-			return &resp, err
+	err := r.parallel(r.withReadSlots(ctx), len(req.Queries), func(ctx context.Context, i int) (err error) {
+		if r.results != nil {
+			results[i], counts[i], err = r.results.query(ctx, r, tenant, req.Queries[i])
+		} else {
+			results[i], counts[i], err = r.Query(ctx, tenant, req.Queries[i], 0)
 		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		// todo: metrics on number of errors, rows, selects, timings, etc
-		rows, err = r.db.Query(sqlStr)
-		cols, _ := rows.Columns()
-		if err != nil {
-			fmt.Printf("Error: query failed: %s", sqlStr)
-			fmt.Printf("Error: query error: %s\n", err)
-			return &resp, err
-		}
-		// build map of timeseries from sql result
-		for rows.Next() {
-			rcount++
-			// Create a slice of interface{}'s to represent each column,
-			// and a second slice to contain pointers to each item in the columns slice.
-			columns := make([]interface{}, len(cols))
-			columnPointers := make([]interface{}, len(cols))
-			for i, _ := range columns {
-				columnPointers[i] = &columns[i]
-			}
-			if err = rows.Scan(columnPointers...); err != nil {
-				fmt.Printf("Error: scan: %s\n", err.Error())
-			}
+	rcount := 0
+	for _, n := range counts {
+		rcount += n
+	}
+	fmt.Printf("query:: returning %d rows for %d queries\n", rcount, len(req.Queries))
+	return &remote.ReadResponse{Results: results}, nil
+}
 
-			// Create our map, and retrieve the value for each column from the pointers slice,
-			// storing it in the map with the name of the column as the key.
-			m := make(map[string]interface{})
-			for i, colName := range cols {
-				val := columnPointers[i].(*interface{})
-				m[colName] = *val
+// parallel calls fn for 0 to n-1 concurrently. The first error cancels the
+// context of the other calls and is returned. The clickhouse queries of the
+// calls are limited by acquire, not the calls themselves, so nested calls
+// share the limit of the request without waiting for each other.
+func (r *p2cReader) parallel(parent context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if errs[i] = fn(ctx, i); errs[i] != nil {
+				cancel()
 			}
+		}(i)
+	}
+	wg.Wait()
 
-			// Outputs: map[columnName:value columnName2:value2 columnName3:value3 ...]
-			//fmt.Print(m)
-			key, value, t, labels := makeLabels(m)
-			// borrowed from influx remote storage adapter - array sep
-			//key := strings.Join(tags, "\xff")
-			ts, ok := tsres[key]
-			if !ok {
-				ts = &remote.TimeSeries{
-					Labels: labels,
-				}
-				tsres[key] = ts
-			}
-			ts.Samples = append(ts.Samples, &remote.Sample{
-				Value:       float64(value),
-				TimestampMs: int64(t),
-			})
+	// report the error that caused the cancellation rather than the
+	// cancellation itself
+	for _, err := range errs {
+		if err != nil && err != context.Canceled {
+			return err
 		}
 	}
-	rows.Close()
-	fmt.Printf("query:: returning %d rows for %d queries\n", rcount, len(req.Queries))
-	return &resp, nil
+	return parent.Err()
+}
+
+// readSlotsKey is the context key of the slots limiting the concurrent
+// clickhouse queries of one request.
+type readSlotsKey struct{}
 
+// withReadSlots returns ctx limited to ReadConcurrency concurrent clickhouse
+// queries, unless it already has a limit.
+func (r *p2cReader) withReadSlots(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(readSlotsKey{}).(chan struct{}); ok {
+		return ctx
+	}
+	concurrency := r.conf.ReadConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return context.WithValue(ctx, readSlotsKey{}, make(chan struct{}, concurrency))
 }
 
-//TODO://根据新的map值反射出名字和值...
-func makeLabels(tags map[string]interface{}) (key string, val float64, ts uint64, lpairs []*remote.LabelPair) {
-	lpairs = make([]*remote.LabelPair, 0, len(tags))
-	// (currently) writer includes __name__ in tags so no need to add it here
-	// may change this to save space later..
-	var keyarray []string
-	var str bytes.Buffer
-	for colname, tag := range tags {
-
-		//获取interface的类型
-		//t := reflect.TypeOf(tag)
-		if colname == "value" {
-			val = reflect.ValueOf(tag).Interface().(float64)
-			continue
+// acquire waits for a free slot of the request limit of ctx, if any, and of
+// the global in-flight query limit and returns the function releasing them.
+func (r *p2cReader) acquire(ctx context.Context) (func(), error) {
+	slots, _ := ctx.Value(readSlotsKey{}).(chan struct{})
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-
-		if colname == "t" {
-			ts = reflect.ValueOf(tag).Interface().(uint64)
-			continue
+	}
+	release := func() {
+		if slots != nil {
+			<-slots
 		}
+	}
+	if r.inflight == nil {
+		return release, nil
+	}
+	select {
+	case r.inflight <- struct{}{}:
+		return func() { <-r.inflight; release() }, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
 
-		if colname == "CNT" {
-			continue
-		}
+// Query runs a single query with samples aggregated over step seconds (0 to
+// derive it from the time range) and returns the result and the number of
+// rows read.
+func (r *p2cReader) Query(ctx context.Context, tenant string, q *remote.Query, step int64) (*remote.QueryResult, int, error) {
+	start, end := time.Unix(0, q.StartTimestampMs*1e6), time.Unix(0, q.EndTimestampMs*1e6)
+	if err := r.checkQuery(q.Matchers, start, end); err != nil {
+		return nil, 0, err
+	}
+	return r.runSplit(r.withReadSlots(ctx), tenant, q, step)
+}
+
+// run runs a query that passed checkQuery.
+func (r *p2cReader) run(ctx context.Context, tenant string, q *remote.Query, step int64) (*remote.QueryResult, int, error) {
+	release, err := r.acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	var res *remote.QueryResult
+	var n int
+	if schema.Layout(r.conf.ChLayout) == schema.LayoutSplit {
+		res, n, err = r.querySplit(ctx, tenant, q, step)
+	} else {
+		res, n, err = r.query(ctx, tenant, q, step)
+	}
+	return res, n, chLimitError(err)
+}
+
+// query runs a single query against the wide layout.
+func (r *p2cReader) query(ctx context.Context, tenant string, q *remote.Query, step int64) (*remote.QueryResult, int, error) {
+	tables := r.readTables(q.Matchers)
+	if len(tables) == 0 {
+		return &remote.QueryResult{Timeseries: make([]*remote.TimeSeries, 0)}, 0, nil
+	}
+
+	// get the select sql
+	sqlStr, err := r.getSQL(tenant, q, step, tables)
+	fmt.Printf("query: running sql: %s\n\n", sqlStr)
+	if err != nil {
+		fmt.Printf("Error: reader: getSQL: %s\n", err.Error())
+		return nil, 0, err
+	}
+
+	// todo: metrics on number of errors, rows, selects, timings, etc
+	rows, err := r.db.DB().QueryContext(ctx, sqlStr)
+	if err != nil {
+		fmt.Printf("Error: query failed: %s", sqlStr)
+		fmt.Printf("Error: query error: %s\n", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
 
-		cv := reflect.ValueOf(tag).Interface().(string)
-		if cv == "" {
-			continue
+	// need to map tags to timeseries to record samples
+	var tsres = make(map[string]*remote.TimeSeries)
+	res := &remote.QueryResult{Timeseries: make([]*remote.TimeSeries, 0)}
+	rcount := 0
+
+	// build map of timeseries from sql result
+	for rows.Next() {
+		rcount++
+		var cnt, t uint64
+		var tags []string
+		var value float64
+		var stale uint8
+		if err = rows.Scan(&cnt, &t, &tags, &value, &stale); err != nil {
+			return nil, rcount, err
 		}
 
-		lpairs = append(lpairs, &remote.LabelPair{
-			Name:  colname,
-			Value: cv,
+		labels := tagsToLabels(tags)
+		key := labelsKey(labels)
+		ts, ok := tsres[key]
+		if !ok {
+			ts = &remote.TimeSeries{
+				Labels: labels,
+			}
+			tsres[key] = ts
+			res.Timeseries = append(res.Timeseries, ts)
+		}
+		if err = r.checkResult(len(res.Timeseries), rcount); err != nil {
+			return nil, rcount, err
+		}
+		ts.Samples = append(ts.Samples, &remote.Sample{
+			Value:       sampleValue(value, stale),
+			TimestampMs: int64(t),
 		})
-		str.WriteString(colname)
-		str.WriteString(cv)
-		keyarray = append(keyarray, str.String())
 	}
-	return strings.Join(keyarray, "\xff"), val, ts, lpairs
+	return res, rcount, rows.Err()
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prom2click/schema"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// the queries of split queries share the limit of the request instead of
+// multiplying it, and waiting for it does not deadlock
+func TestNestedParallelSharesReadSlots(t *testing.T) {
+	r := &p2cReader{conf: &config{ReadConcurrency: 2}, inflight: make(chan struct{}, 16)}
+
+	var mu sync.Mutex
+	running, max := 0, 0
+	query := func(ctx context.Context) error {
+		release, err := r.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx := r.withReadSlots(context.Background())
+		done <- r.parallel(ctx, 4, func(ctx context.Context, i int) error {
+			return r.parallel(r.withReadSlots(ctx), 4, func(ctx context.Context, j int) error {
+				return query(ctx)
+			})
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested queries deadlocked")
+	}
+	if max > 2 {
+		t.Errorf("%d queries ran at once, want at most 2", max)
+	}
+	if len(r.inflight) != 0 {
+		t.Errorf("%d in-flight slots not released", len(r.inflight))
+	}
+}
+
+// a series in two tables, eg. after its job moved to another table, has a
+// single value per step: the samples of the tables are grouped together
+// rather than per table
+func TestSamplesOfOverlappingTablesGroupedOnce(t *testing.T) {
+	tables := []string{"samples_a", "samples_b"}
+	q := &remote.Query{
+		StartTimestampMs: 1000000,
+		EndTimestampMs:   2000000,
+		Matchers:         []*remote.LabelMatcher{{Type: remote.MatchType_EQUAL, Name: "__name__", Value: "up"}},
+	}
+	r := &p2cReader{conf: &config{ChDB: "metrics", CHQuantile: 0.75, CHMaxSamples: 11000, CHMinPeriod: 10}}
+	rollups := &p2cReader{conf: &config{ChDB: "metrics", CHQuantile: 0.75, CHMaxSamples: 11000, CHMinPeriod: 60}}
+	rollups.conf.spec.Rollups = []schema.Rollup{{Name: "1m", Resolution: time.Minute}}
+
+	wide, err := r.samplesSQL("", q, 0, tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollup, err := rollups.samplesSQL("", q, 0, tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	split, err := r.splitSamplesSQL(q, 0, tables, []string{"1", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name, sql, group string
+		tables           []string
+	}{
+		{name: "wide", sql: wide, group: "GROUP BY t, tags", tables: tables},
+		{name: "rollup", sql: rollup, group: "GROUP BY t, tags", tables: []string{"samples_a_1m", "samples_b_1m"}},
+		{name: "split", sql: split, group: "GROUP BY t, fingerprint", tables: tables},
+	} {
+		if n := strings.Count(c.sql, "GROUP BY"); n != 1 {
+			t.Errorf("%s: %d GROUP BY, want one over the union of the tables:\n%s", c.name, n, c.sql)
+			continue
+		}
+		group := strings.Index(c.sql, c.group)
+		if group < 0 || group < strings.LastIndex(c.sql, "UNION ALL") {
+			t.Errorf("%s: the samples are not grouped by %q after the union:\n%s", c.name, c.group, c.sql)
+		}
+		for _, table := range c.tables {
+			if strings.Count(c.sql, "FROM metrics."+table+" ") != 1 {
+				t.Errorf("%s: table %s is not read once:\n%s", c.name, table, c.sql)
+			}
+		}
+	}
+}
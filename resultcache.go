@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prom2click/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// resultsCache caches remote read results in chunks of whole steps, like
+// the thanos query frontend: a read is split at chunk boundaries, chunks
+// older than the max freshness are taken from the cache and only the others
+// are queried. Dashboards refreshing the same range then only re-query the
+// recent tail.
+type resultsCache struct {
+	store     cache.Store
+	chunk     int64 // seconds
+	freshness time.Duration
+
+	requests *prometheus.CounterVec
+}
+
+func newResultsCache(conf *config) (*resultsCache, error) {
+	mem := cache.NewLRU(conf.ReadCacheSize, conf.ReadCacheTTL)
+	c := &resultsCache{
+		store:     mem,
+		chunk:     int64(conf.ReadCacheChunk / time.Second),
+		freshness: conf.ReadCacheFreshness,
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "results_cache_requests_total",
+				Help: "Total number of lookups of finalised remote read chunks, by whether they were answered from the cache.",
+			},
+			[]string{"result"},
+		),
+	}
+	if c.chunk < 1 {
+		return nil, fmt.Errorf("invalid read.cache-chunk %s: must be at least 1s", conf.ReadCacheChunk)
+	}
+	if conf.ReadCacheDir != "" {
+		disk, err := cache.OpenDisk(conf.ReadCacheDir, conf.ReadCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("opening read.cache-dir %s: %s", conf.ReadCacheDir, err)
+		}
+		disk.Start(time.Hour)
+		c.store = &cache.Tiered{Memory: mem, Disk: disk}
+	}
+	bytes := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "results_cache_bytes",
+			Help: "Size of the remote read results cached in memory.",
+		},
+		func() float64 { return float64(mem.Bytes()) },
+	)
+	prometheus.MustRegister(c.requests, bytes)
+	return c, nil
+}
+
+// key identifies the chunks of a query; the chunk start is appended.
+func (c *resultsCache) key(r *p2cReader, tenant string, matchers []*remote.LabelMatcher, step, chunk int64) string {
+	ms := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		ms = append(ms, fmt.Sprintf("%s\xfe%d\xfe%s", m.Name, m.Type, m.Value))
+	}
+	sort.Strings(ms)
+	return fmt.Sprintf("v2\xff%s.%s\xff%s\xff%d\xff%d\xff%g\xff%s\xff",
+		r.conf.ChDB, strings.Join(r.readTables(matchers), ","), tenant, step, chunk, r.conf.CHQuantile, strings.Join(ms, "\xfd"))
+}
+
+// query answers a remote read query from the cache and clickhouse. The
+// chunks are evaluated whole, so the first point may aggregate samples from
+// before the start of the query, as if it was aligned to the step.
+func (c *resultsCache) query(ctx context.Context, r *p2cReader, tenant string, q *remote.Query) (*remote.QueryResult, int, error) {
+	tstart, tend := q.StartTimestampMs/1000, q.EndTimestampMs/1000
+	if tend < tstart {
+		return r.Query(ctx, tenant, q, 0)
+	}
+	if err := r.checkQuery(q.Matchers, time.Unix(0, q.StartTimestampMs*1e6), time.Unix(0, q.EndTimestampMs*1e6)); err != nil {
+		return nil, 0, err
+	}
+
+	step, _ := r.getStep(r.defaultStep(tstart, tend))
+	chunk := (c.chunk + step - 1) / step * step
+	fresh := time.Now().Add(-c.freshness).Unix()
+	prefix := c.key(r, tenant, q.Matchers, step, chunk)
+
+	var parts []*remote.QueryResult
+	missing := int64(-1)
+	// fetch queries the chunks from missing up to end in one go
+	fetch := func(end int64) error {
+		sub := &remote.Query{StartTimestampMs: missing * 1000, EndTimestampMs: (end - 1) * 1000, Matchers: q.Matchers}
+		res, _, err := r.runSplit(ctx, tenant, sub, step)
+		if err != nil {
+			return err
+		}
+		for cs := missing; cs < end && cs+chunk <= fresh; cs += chunk {
+			data, err := proto.Marshal(sliceResult(res, cs*1000, (cs+chunk)*1000))
+			if err == nil {
+				c.store.Set(fmt.Sprintf("%s%d", prefix, cs), data)
+			}
+		}
+		parts = append(parts, res)
+		missing = -1
+		return nil
+	}
+
+	cs := tstart / chunk * chunk
+	for ; cs <= tend; cs += chunk {
+		if cs+chunk <= fresh {
+			if data, ok := c.store.Get(fmt.Sprintf("%s%d", prefix, cs)); ok {
+				var res remote.QueryResult
+				if err := proto.Unmarshal(data, &res); err == nil {
+					c.requests.WithLabelValues("hit").Inc()
+					if missing >= 0 {
+						if err := fetch(cs); err != nil {
+							return nil, 0, err
+						}
+					}
+					parts = append(parts, &res)
+					continue
+				}
+			}
+			c.requests.WithLabelValues("miss").Inc()
+		}
+		if missing < 0 {
+			missing = cs
+		}
+	}
+	if missing >= 0 {
+		if err := fetch(cs); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	res, n := mergeResults(parts, tstart/step*step*1000, tend*1000)
+	if err := r.checkResult(len(res.Timeseries), n); err != nil {
+		return nil, n, err
+	}
+	return res, n, nil
+}
+
+// labelsKey identifies a series by its labels, in any order.
+func labelsKey(labels []*remote.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.Name+"\xfe"+l.Value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
+
+// sliceResult returns the samples of res from from up to before to, in ms.
+func sliceResult(res *remote.QueryResult, from, to int64) *remote.QueryResult {
+	out := &remote.QueryResult{}
+	for _, ts := range res.Timeseries {
+		var samples []*remote.Sample
+		for _, s := range ts.Samples {
+			if s.TimestampMs >= from && s.TimestampMs < to {
+				samples = append(samples, s)
+			}
+		}
+		if len(samples) > 0 {
+			out.Timeseries = append(out.Timeseries, &remote.TimeSeries{Labels: ts.Labels, Samples: samples})
+		}
+	}
+	return out
+}
+
+// mergeResults concatenates the samples of consecutive parts per series,
+// keeping those from from to to in ms, and returns the number of samples.
+func mergeResults(parts []*remote.QueryResult, from, to int64) (*remote.QueryResult, int) {
+	res := &remote.QueryResult{Timeseries: make([]*remote.TimeSeries, 0)}
+	series := make(map[string]*remote.TimeSeries)
+	n := 0
+	for _, part := range parts {
+		for _, ts := range part.Timeseries {
+			key := labelsKey(ts.Labels)
+			merged, ok := series[key]
+			for _, s := range ts.Samples {
+				if s.TimestampMs < from || s.TimestampMs > to {
+					continue
+				}
+				if !ok {
+					merged = &remote.TimeSeries{Labels: ts.Labels}
+					series[key] = merged
+					res.Timeseries = append(res.Timeseries, merged)
+					ok = true
+				}
+				merged.Samples = append(merged.Samples, s)
+				n++
+			}
+		}
+	}
+	return res, n
+}
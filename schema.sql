@@ -1,102 +1,121 @@
-# note:REPLACE {shard} AND {REPLICA} AND run ON EACH SERVER
-
-
-// LOCAL test TABLE ON ubuntu ..
-CREATE TABLE metrics.samples (
-  ip            STRING   DEFAULT 'default',
-  app           STRING   DEFAULT 'x',
-  name          STRING   DEFAULT 'x',
-  job           STRING   DEFAULT 'x',
-  namespace     STRING   DEFAULT 'x',
-  shard         STRING   DEFAULT 'x',
-  keyspace      STRING   DEFAULT 'x',
-  component     STRING   DEFAULT 'x',
-  containername STRING   DEFAULT 'x',
-  val           FLOAT64,
-  ts            DATETIME,
-  date          DATE     DEFAULT toDate(0),
-  tags ARRAY (String),
-  updated       DATETIME DEFAULT now()
-)
-  ENGINE = MergeTree PARTITION BY toMonday (date
-) ORDER BY (date, NAME, ts
-) SETTINGS index_granularity = 8192
+-- Generated by `prom2click schema init -schema.dry-run`, prefer running the
+-- schema command against your own job config over editing this file.
+--
+-- single server
+CREATE DATABASE IF NOT EXISTS metrics;
 
+CREATE TABLE IF NOT EXISTS metrics.samples (
+  ip String DEFAULT 'x',
+  app String DEFAULT 'x',
+  name String DEFAULT 'x',
+  job String DEFAULT 'x',
+  namespace String DEFAULT 'x',
+  shard String DEFAULT 'x',
+  keyspace String DEFAULT 'x',
+  component String DEFAULT 'x',
+  containername String DEFAULT 'x',
+  val Float64,
+  ts DateTime,
+  date Date DEFAULT toDate(0),
+  tags Array(String),
+  updated DateTime DEFAULT now(),
+  stale UInt8 DEFAULT 0
+) ENGINE = MergeTree PARTITION BY toMonday(date) ORDER BY (date, name, ts) SETTINGS index_granularity = 8192;
 
-// LOCAL TABLE ON Centos ..
-CREATE TABLE metrics.samples (
-  ip            STRING   DEFAULT 'default',
-  app           STRING   DEFAULT 'x',
-  name          STRING   DEFAULT 'x',
-  job           STRING   DEFAULT 'x',
-  namespace     STRING   DEFAULT 'x',
-  shard         STRING   DEFAULT 'x',
-  keyspace      STRING   DEFAULT 'x',
-  component     STRING   DEFAULT 'x',
-  containername STRING   DEFAULT 'x',
-  val           FLOAT64,
-  ts            DATETIME,
-  date          DATE     DEFAULT toDate(0),
-  tags ARRAY (String),
-  updated       DATETIME DEFAULT now()
-)ENGINE = MergeTree PARTITION BY toMonday (date) ORDER BY (date, NAME, ts) SETTINGS index_granularity = 8192;
+-- replicated and distributed over a cluster:
+-- prom2click -schema.cluster=metrics -schema.replicated -schema.distributed schema init
+CREATE DATABASE IF NOT EXISTS metrics ON CLUSTER metrics;
 
+CREATE TABLE IF NOT EXISTS metrics.samples_local ON CLUSTER metrics (
+  ip String DEFAULT 'x',
+  app String DEFAULT 'x',
+  name String DEFAULT 'x',
+  job String DEFAULT 'x',
+  namespace String DEFAULT 'x',
+  shard String DEFAULT 'x',
+  keyspace String DEFAULT 'x',
+  component String DEFAULT 'x',
+  containername String DEFAULT 'x',
+  val Float64,
+  ts DateTime,
+  date Date DEFAULT toDate(0),
+  tags Array(String),
+  updated DateTime DEFAULT now(),
+  stale UInt8 DEFAULT 0
+) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/metrics.samples_local', '{replica}') PARTITION BY toMonday(date) ORDER BY (date, name, ts) SETTINGS index_granularity = 8192;
 
+CREATE TABLE IF NOT EXISTS metrics.samples ON CLUSTER metrics (
+  ip String DEFAULT 'x',
+  app String DEFAULT 'x',
+  name String DEFAULT 'x',
+  job String DEFAULT 'x',
+  namespace String DEFAULT 'x',
+  shard String DEFAULT 'x',
+  keyspace String DEFAULT 'x',
+  component String DEFAULT 'x',
+  containername String DEFAULT 'x',
+  val Float64,
+  ts DateTime,
+  date Date DEFAULT toDate(0),
+  tags Array(String),
+  updated DateTime DEFAULT now(),
+  stale UInt8 DEFAULT 0
+) ENGINE = Distributed(metrics, metrics, samples_local, rand());
 
-CREATE TABLE metrics.samples (
-  ip            STRING   DEFAULT 'default',
-  app           STRING   DEFAULT 'x',
-  name          STRING   DEFAULT 'x',
-  job           STRING   DEFAULT 'x',
-  namespace     STRING   DEFAULT 'x',
-  shard         STRING   DEFAULT 'x',
-  keyspace      STRING   DEFAULT 'x',
-  component     STRING   DEFAULT 'x',
-  containername STRING   DEFAULT 'x',
-  val           FLOAT64,
-  ts            DATETIME,
-  date          DATE     DEFAULT toDate(0),
-  tags ARRAY (String),
-  updated       DATETIME DEFAULT now()
-)ENGINE = ReplicatedGraphiteMergeTree ('/clickhouse/tables/{shard}/metrics.samples','{replica}', partition by toMonday(date) order by  (date, name, ts) settings index_granularity=8192);
+-- single server with rollups, staleness markers are left out of them:
+-- prom2click -ch.rollups=1m,1h schema init
+CREATE DATABASE IF NOT EXISTS metrics;
 
-===线上操作步骤===
+CREATE TABLE IF NOT EXISTS metrics.samples (
+  ip String DEFAULT 'x',
+  app String DEFAULT 'x',
+  name String DEFAULT 'x',
+  job String DEFAULT 'x',
+  namespace String DEFAULT 'x',
+  shard String DEFAULT 'x',
+  keyspace String DEFAULT 'x',
+  component String DEFAULT 'x',
+  containername String DEFAULT 'x',
+  val Float64,
+  ts DateTime,
+  date Date DEFAULT toDate(0),
+  tags Array(String),
+  updated DateTime DEFAULT now(),
+  stale UInt8 DEFAULT 0
+) ENGINE = MergeTree PARTITION BY toMonday(date) ORDER BY (date, name, ts) SETTINGS index_granularity = 8192;
 
-DROP DATABASE IF EXISTS metrics  ON CLUSTER ads_app_clickhouse_cluster;
+CREATE TABLE IF NOT EXISTS metrics.samples_1m (
+  ip String DEFAULT 'x',
+  app String DEFAULT 'x',
+  name String DEFAULT 'x',
+  job String DEFAULT 'x',
+  namespace String DEFAULT 'x',
+  shard String DEFAULT 'x',
+  keyspace String DEFAULT 'x',
+  component String DEFAULT 'x',
+  containername String DEFAULT 'x',
+  tags Array(String),
+  ts DateTime,
+  date Date,
+  val AggregateFunction(quantile(0.75), Float64)
+) ENGINE = AggregatingMergeTree PARTITION BY toMonday(date) ORDER BY (date, name, tags, ts) SETTINGS index_granularity = 8192;
 
-create database metrics on cluster ads_app_clickhouse_cluster;
- 
-CREATE TABLE IF NOT EXISTS metrics.samples (
-  ip            String   DEFAULT 'x',
-  app           String   DEFAULT 'x',
-  name          String   DEFAULT 'x',
-  job           String   DEFAULT 'x',
-  namespace     String   DEFAULT 'x',
-  shard         String   DEFAULT 'x',
-  keyspace      String   DEFAULT 'x',
-  component     String   DEFAULT 'x',
-  containername String   DEFAULT 'x',
-  val           Float64,
-  ts            DateTime,
-  date          Date     DEFAULT toDate(0),
-  tags          Array(String),
-  updated       DateTime DEFAULT now()
-)ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/metrics.samples','{replica}') PARTITION BY toMonday(date) ORDER BY (date, name, ts) SETTINGS index_granularity = 8192;
+CREATE MATERIALIZED VIEW IF NOT EXISTS metrics.samples_1m_mv TO metrics.samples_1m AS SELECT ip, app, name, job, namespace, shard, keyspace, component, containername, tags, bucket AS ts, toDate(bucket) AS date, quantileState(0.75)(v) AS val FROM (SELECT ip, app, name, job, namespace, shard, keyspace, component, containername, tags, toDateTime(intDiv(toUInt32(ts), 60) * 60) AS bucket, val AS v FROM metrics.samples WHERE stale = 0) GROUP BY ip, app, name, job, namespace, shard, keyspace, component, containername, tags, bucket;
 
+CREATE TABLE IF NOT EXISTS metrics.samples_1h (
+  ip String DEFAULT 'x',
+  app String DEFAULT 'x',
+  name String DEFAULT 'x',
+  job String DEFAULT 'x',
+  namespace String DEFAULT 'x',
+  shard String DEFAULT 'x',
+  keyspace String DEFAULT 'x',
+  component String DEFAULT 'x',
+  containername String DEFAULT 'x',
+  tags Array(String),
+  ts DateTime,
+  date Date,
+  val AggregateFunction(quantile(0.75), Float64)
+) ENGINE = AggregatingMergeTree PARTITION BY toMonday(date) ORDER BY (date, name, tags, ts) SETTINGS index_granularity = 8192;
 
-CREATE TABLE IF NOT EXISTS metrics.distribute ON CLUSTER ads_app_clickhouse_cluster(
-  ip            String   DEFAULT 'x',
-  app           String   DEFAULT 'x',
-  name          String   DEFAULT 'x',
-  job           String   DEFAULT 'x',
-  namespace     String   DEFAULT 'x',
-  shard         String   DEFAULT 'x',
-  keyspace      String   DEFAULT 'x',
-  component     String   DEFAULT 'x',
-  containername String   DEFAULT 'x',
-  val           Float64,
-  ts            DateTime,
-  date          Date     DEFAULT toDate(0),
-  tags          Array(String),
-  updated       DateTime DEFAULT now()
-)ENGINE = Distributed(ads_app_clickhouse_cluster, metrics, samples,rand())
+CREATE MATERIALIZED VIEW IF NOT EXISTS metrics.samples_1h_mv TO metrics.samples_1h AS SELECT ip, app, name, job, namespace, shard, keyspace, component, containername, tags, bucket AS ts, toDate(bucket) AS date, quantileState(0.75)(v) AS val FROM (SELECT ip, app, name, job, namespace, shard, keyspace, component, containername, tags, toDateTime(intDiv(toUInt32(ts), 3600) * 3600) AS bucket, val AS v FROM metrics.samples WHERE stale = 0) GROUP BY ip, app, name, job, namespace, shard, keyspace, component, containername, tags, bucket;
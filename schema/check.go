@@ -0,0 +1,114 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prom2click/config"
+	"github.com/prom2click/database"
+)
+
+var columnsSQL = `SELECT name, type FROM system.columns WHERE database = ? AND table = ?`
+var engineSQL = `SELECT engine_full FROM system.tables WHERE database = ? AND name = ?`
+
+// Checker verifies tables referenced by the config against a live clickhouse.
+type Checker struct {
+	db       *database.Pool
+	database string
+	spec     Spec
+}
+
+func NewChecker(db *database.Pool, database string, spec Spec) *Checker {
+	return &Checker{db: db, database: database, spec: spec}
+}
+
+// LiveColumns returns the columns of database.table keyed by name, or an
+// empty map if the table does not exist.
+func (c *Checker) LiveColumns(table string) (map[string]string, error) {
+	rows, err := c.db.DB().Query(columnsSQL, c.database, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err = rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		cols[name] = typ
+	}
+	return cols, rows.Err()
+}
+
+// Diff compares the live table against the expected columns.
+func (c *Checker) Diff(table string, want []Column) (Diff, error) {
+	live, err := c.LiveColumns(table)
+	if err != nil {
+		return Diff{}, fmt.Errorf("table %s.%s: %v", c.database, table, err)
+	}
+	return Compare(table, live, want), nil
+}
+
+// DiffTTL sets d.TTL if the live table does not expire rows after ttl.
+func (c *Checker) DiffTTL(d *Diff, ttl string) error {
+	if ttl == "" || d.Missing {
+		return nil
+	}
+	var engine string
+	if err := c.db.DB().QueryRow(engineSQL, c.database, d.Table).Scan(&engine); err != nil {
+		return fmt.Errorf("table %s.%s: %v", c.database, d.Table, err)
+	}
+	if !strings.Contains(engine, "TTL "+ttl) {
+		d.TTL = ttl
+	}
+	return nil
+}
+
+// CheckTable returns an error describing every missing or mistyped column of
+// the tables backing the job table name.
+func (c *Checker) CheckTable(name string) error {
+	for _, t := range c.spec.Tables(name, Retention{}) {
+		d, err := c.Diff(t.Name, t.Columns)
+		if err != nil {
+			return err
+		}
+		if d.Missing {
+			return fmt.Errorf("table %s.%s does not exist", c.database, t.Name)
+		}
+		// unknown columns are fine as long as they have defaults, which the
+		// insert will fill in
+		d.Extra = nil
+		if !d.Empty() {
+			return fmt.Errorf("%s (database %s)", d, c.database)
+		}
+	}
+	return nil
+}
+
+// Exec runs a DDL statement.
+func (c *Checker) Exec(stmt string) error {
+	_, err := c.db.DB().Exec(stmt)
+	return err
+}
+
+// Validate is a config.Validator checking that every job's table exists
+// with the expected columns.
+func (c *Checker) Validate(cfg *config.Config) error {
+	verr := &config.ValidationError{}
+	checked := make(map[string]bool)
+	for _, j := range cfg.Jobs {
+		if checked[j.Table] {
+			continue
+		}
+		checked[j.Table] = true
+		if err := c.CheckTable(j.Table); err != nil {
+			verr.Problems = append(verr.Problems, fmt.Sprintf("job %q: %v", j.Name, err))
+		}
+	}
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package schema
+
+// Column is a clickhouse column the writer and reader depend on.
+type Column struct {
+	Name    string
+	Type    string
+	Default string
+}
+
+// Columns is the layout of a samples table as written by p2cWriter.
+var Columns = []Column{
+	{"ip", "String", "'x'"},
+	{"app", "String", "'x'"},
+	{"name", "String", "'x'"},
+	{"job", "String", "'x'"},
+	{"namespace", "String", "'x'"},
+	{"shard", "String", "'x'"},
+	{"keyspace", "String", "'x'"},
+	{"component", "String", "'x'"},
+	{"containername", "String", "'x'"},
+	{"val", "Float64", ""},
+	{"ts", "DateTime", ""},
+	{"date", "Date", "toDate(0)"},
+	{"tags", "Array(String)", ""},
+	{"updated", "DateTime", "now()"},
+	// stale is 1 when val is a staleness marker, which aggregates skip
+	{"stale", "UInt8", "0"},
+}
+
+// definition renders the column as used in CREATE and ALTER statements.
+func (c Column) definition() string {
+	if c.Default == "" {
+		return c.Name + " " + c.Type
+	}
+	return c.Name + " " + c.Type + " DEFAULT " + c.Default
+}
+
+// SeriesColumns is the layout of the series table of the split layout, one
+// row per series.
+var SeriesColumns = []Column{
+	{"fingerprint", "UInt64", ""},
+	{"name", "String", "'x'"},
+	{"job", "String", "'x'"},
+	{"labels", "Array(String)", ""},
+	{"updated", "DateTime", "now()"},
+}
+
+// TenantColumn is added to the samples table of the wide layout and the
+// series table of the split layout when tenants are enabled.
+var TenantColumn = Column{"tenant", "String", "''"}
+
+// SplitColumns is the layout of the narrow samples table of the split layout.
+var SplitColumns = []Column{
+	{"fingerprint", "UInt64", ""},
+	{"val", "Float64", ""},
+	{"ts", "DateTime", ""},
+	{"date", "Date", "toDate(ts)"},
+	{"stale", "UInt8", "0"},
+}
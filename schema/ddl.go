@@ -0,0 +1,208 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Options control how tables are laid out on the clickhouse server(s).
+type Options struct {
+	Database string
+	// Cluster adds ON CLUSTER to every statement and is the cluster
+	// Distributed tables spread over.
+	Cluster string
+	// Replicated uses the Replicated* variant of the table engine.
+	Replicated bool
+	// ZKPath is the zookeeper path of replicated tables, %s is replaced by
+	// database.table.
+	ZKPath  string
+	Replica string
+	// Distributed creates the data in <table><LocalSuffix> on every shard and
+	// a Distributed table named <table> over it.
+	Distributed bool
+	LocalSuffix string
+}
+
+// Table describes a table prom2click manages.
+type Table struct {
+	Name        string
+	Columns     []Column
+	Engine      string
+	EngineArgs  []string
+	PartitionBy string
+	OrderBy     string
+	// TTL is the expression after which rows expire, empty keeps them forever
+	TTL string
+
+	// rollup is set for rollup tables, which are filled by a materialized view
+	rollup *rollupSource
+}
+
+// Layout is how samples are stored.
+type Layout string
+
+const (
+	// LayoutWide stores every sample together with all its labels.
+	LayoutWide Layout = "wide"
+	// LayoutSplit stores the labels once per series in <table>_series and
+	// only fingerprint, timestamp and value per sample in <table>.
+	LayoutSplit Layout = "split"
+)
+
+// SeriesSuffix is appended to a job's table to name its series table.
+const SeriesSuffix = "_series"
+
+// Tables returns the tables backing the job table name in layout l, the
+// samples table comes last. Use Spec.Tables to get the rollups and TTLs too.
+func (l Layout) Tables(name string) []Table {
+	if l == LayoutSplit {
+		return []Table{SeriesTable(name + SeriesSuffix), SplitSamplesTable(name)}
+	}
+	return []Table{SamplesTable(name)}
+}
+
+// SamplesTable is the table a job writes its samples to.
+func SamplesTable(name string) Table {
+	return Table{
+		Name:        name,
+		Columns:     Columns,
+		Engine:      "MergeTree",
+		PartitionBy: "toMonday(date)",
+		OrderBy:     "(date, name, ts)",
+	}
+}
+
+// SeriesTable is the series table of the split layout. Series may be written
+// more than once (eg. after a restart), the engine collapses duplicates.
+func SeriesTable(name string) Table {
+	return Table{
+		Name:       name,
+		Columns:    SeriesColumns,
+		Engine:     "ReplacingMergeTree",
+		EngineArgs: []string{"updated"},
+		OrderBy:    "(name, fingerprint)",
+	}
+}
+
+// SplitSamplesTable is the narrow samples table of the split layout.
+func SplitSamplesTable(name string) Table {
+	return Table{
+		Name:        name,
+		Columns:     SplitColumns,
+		Engine:      "MergeTree",
+		PartitionBy: "toMonday(date)",
+		OrderBy:     "(fingerprint, ts)",
+	}
+}
+
+func (t Table) hasColumn(name string) bool {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OnCluster is the ON CLUSTER clause of statements, if any.
+func (o Options) OnCluster() string {
+	if o.Cluster == "" {
+		return ""
+	}
+	return " ON CLUSTER " + o.Cluster
+}
+
+// LocalName is the table holding the data, which differs from the table
+// written to for Distributed layouts.
+func (o Options) LocalName(t Table) string {
+	if o.Distributed {
+		return t.Name + o.LocalSuffix
+	}
+	return t.Name
+}
+
+// Physical returns every table backing t, the diff and migration is run on
+// each of them.
+func (o Options) Physical(t Table) []string {
+	if o.Distributed {
+		return []string{o.LocalName(t), t.Name}
+	}
+	return []string{t.Name}
+}
+
+func (o Options) engine(t Table) string {
+	name, args := t.Engine, t.EngineArgs
+	if o.Replicated {
+		name = "Replicated" + name
+		zkpath := fmt.Sprintf(o.ZKPath, o.Database+"."+o.LocalName(t))
+		args = append([]string{quote(zkpath), quote(o.Replica)}, args...)
+	}
+	if len(args) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(args, ", "))
+}
+
+func columnsDDL(cols []Column) string {
+	defs := make([]string, 0, len(cols))
+	for _, c := range cols {
+		defs = append(defs, "  "+c.definition())
+	}
+	return strings.Join(defs, ",\n")
+}
+
+// CreateDatabase returns the statement creating the database.
+func (o Options) CreateDatabase() string {
+	return fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s%s", o.Database, o.OnCluster())
+}
+
+// Create returns the statements creating t, in the order they must run.
+func (o Options) Create(t Table) []string {
+	partition := ""
+	if t.PartitionBy != "" {
+		partition = " PARTITION BY " + t.PartitionBy
+	}
+	ttl := ""
+	if t.TTL != "" {
+		ttl = " TTL " + t.TTL
+	}
+	local := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s%s (\n%s\n) ENGINE = %s%s ORDER BY %s%s SETTINGS index_granularity = 8192",
+		o.Database, o.LocalName(t), o.OnCluster(), columnsDDL(t.Columns), o.engine(t), partition, t.OrderBy, ttl)
+	stmts := []string{local}
+	if t.rollup != nil {
+		// the view lives next to the local tables so every shard rolls up
+		// its own data
+		stmts = append(stmts, fmt.Sprintf("CREATE MATERIALIZED VIEW IF NOT EXISTS %s.%s_mv%s TO %s.%s AS %s",
+			o.Database, o.LocalName(t), o.OnCluster(), o.Database, o.LocalName(t), o.viewSQL(t)))
+	}
+	if !o.Distributed {
+		return stmts
+	}
+
+	dist := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s%s (\n%s\n) ENGINE = Distributed(%s, %s, %s, rand())",
+		o.Database, t.Name, o.OnCluster(), columnsDDL(t.Columns), o.Cluster, o.Database, o.LocalName(t))
+	return append(stmts, dist)
+}
+
+// Alter returns the statements bringing the physical table in line with d.
+// Extra columns are left alone, dropping data is up to the operator.
+func (o Options) Alter(d Diff) []string {
+	var stmts []string
+	for _, c := range d.Add {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s.%s%s ADD COLUMN %s",
+			o.Database, d.Table, o.OnCluster(), c.definition()))
+	}
+	for _, c := range d.Modify {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s.%s%s MODIFY COLUMN %s",
+			o.Database, d.Table, o.OnCluster(), c.definition()))
+	}
+	if d.TTL != "" {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s.%s%s MODIFY TTL %s",
+			o.Database, d.Table, o.OnCluster(), d.TTL))
+	}
+	return stmts
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
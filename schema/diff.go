@@ -0,0 +1,78 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Diff is the difference between a live table and the columns we expect.
+type Diff struct {
+	Table   string
+	Missing bool
+	Add     []Column
+	Modify  []Column
+	// Extra are live columns we do not know about
+	Extra []string
+	// Live maps the column names of modified columns to their live type
+	Live map[string]string
+	// TTL is set to the expected TTL if the live table lacks it
+	TTL string
+}
+
+func (d Diff) Empty() bool {
+	return !d.Missing && len(d.Add) == 0 && len(d.Modify) == 0 && d.TTL == ""
+}
+
+func (d Diff) String() string {
+	if d.Missing {
+		return fmt.Sprintf("table %s does not exist", d.Table)
+	}
+	var problems []string
+	for _, c := range d.Add {
+		problems = append(problems, fmt.Sprintf("missing column %s", c.Name))
+	}
+	for _, c := range d.Modify {
+		problems = append(problems, fmt.Sprintf("column %s is %s, expected %s", c.Name, d.Live[c.Name], c.Type))
+	}
+	for _, name := range d.Extra {
+		problems = append(problems, fmt.Sprintf("unexpected column %s", name))
+	}
+	if d.TTL != "" {
+		problems = append(problems, fmt.Sprintf("TTL is not %s", d.TTL))
+	}
+	if len(problems) == 0 {
+		return fmt.Sprintf("table %s is up to date", d.Table)
+	}
+	return fmt.Sprintf("table %s: %s", d.Table, strings.Join(problems, ", "))
+}
+
+// Compare diffs the live columns of table against want.
+func Compare(table string, live map[string]string, want []Column) Diff {
+	d := Diff{Table: table, Live: make(map[string]string)}
+	if len(live) == 0 {
+		d.Missing = true
+		return d
+	}
+
+	known := make(map[string]bool, len(want))
+	for _, col := range want {
+		known[col.Name] = true
+		typ, ok := live[col.Name]
+		if !ok {
+			d.Add = append(d.Add, col)
+			continue
+		}
+		if typ != col.Type {
+			d.Modify = append(d.Modify, col)
+			d.Live[col.Name] = typ
+		}
+	}
+	for name := range live {
+		if !known[name] {
+			d.Extra = append(d.Extra, name)
+		}
+	}
+	sort.Strings(d.Extra)
+	return d
+}
@@ -0,0 +1,169 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Rollup is a pre-aggregated copy of a samples table at a coarser resolution,
+// kept up to date by a materialized view. It is named <table>_<Name>.
+type Rollup struct {
+	Name       string
+	Resolution time.Duration
+}
+
+// ParseRollups parses a comma separated list of resolutions such as
+// "1m,5m,1h" and returns them finest first.
+func ParseRollups(s string) ([]Rollup, error) {
+	var rollups []Rollup
+	seen := make(map[time.Duration]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		d, err := model.ParseDuration(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup %q: %v", name, err)
+		}
+		res := time.Duration(d)
+		if res < time.Second || res%time.Second != 0 {
+			return nil, fmt.Errorf("invalid rollup %q: resolution must be whole seconds", name)
+		}
+		if seen[res] {
+			return nil, fmt.Errorf("duplicate rollup %q", name)
+		}
+		seen[res] = true
+		rollups = append(rollups, Rollup{Name: name, Resolution: res})
+	}
+	sort.Slice(rollups, func(i, j int) bool { return rollups[i].Resolution < rollups[j].Resolution })
+	return rollups, nil
+}
+
+// Seconds is the rollup resolution in seconds.
+func (r Rollup) Seconds() int64 {
+	return int64(r.Resolution / time.Second)
+}
+
+// TableName is the name of the rollup of the samples table name.
+func (r Rollup) TableName(name string) string {
+	return name + "_" + r.Name
+}
+
+// rollupSource links a rollup table to the samples table its view reads.
+type rollupSource struct {
+	table      Table
+	resolution int64
+	quantile   float64
+	// group are the columns the samples are aggregated by besides time
+	group []string
+}
+
+// QuantileState is the type of the aggregated value column of rollups.
+func QuantileState(quantile float64) string {
+	return fmt.Sprintf("AggregateFunction(quantile(%s), Float64)", formatQuantile(quantile))
+}
+
+func formatQuantile(q float64) string {
+	return strconv.FormatFloat(q, 'f', -1, 64)
+}
+
+// RollupTable is the rollup r of the samples table source, storing the
+// quantile state of val per series and time bucket.
+func RollupTable(source Table, r Rollup, quantile float64) Table {
+	t := Table{
+		Name:        r.TableName(source.Name),
+		Engine:      "AggregatingMergeTree",
+		PartitionBy: "toMonday(date)",
+	}
+
+	var group []string
+	for _, c := range source.Columns {
+		switch c.Name {
+		case "ts", "date", "val", "updated", "stale":
+			continue
+		}
+		t.Columns = append(t.Columns, Column{Name: c.Name, Type: c.Type, Default: c.Default})
+		group = append(group, c.Name)
+	}
+	t.Columns = append(t.Columns,
+		Column{Name: "ts", Type: "DateTime"},
+		Column{Name: "date", Type: "Date"},
+		Column{Name: "val", Type: QuantileState(quantile)},
+	)
+
+	// the sorting key must identify a series, rows with the same key are
+	// merged into one
+	switch {
+	case source.Columns[0].Name == "fingerprint":
+		t.OrderBy = "(fingerprint, ts)"
+	case source.hasColumn(TenantColumn.Name):
+		t.OrderBy = "(date, tenant, name, tags, ts)"
+	default:
+		t.OrderBy = "(date, name, tags, ts)"
+	}
+	t.rollup = &rollupSource{table: source, resolution: r.Seconds(), quantile: quantile, group: group}
+	return t
+}
+
+// viewSQL is the SELECT of the materialized view filling the rollup t from
+// the local samples table source. Staleness markers are left out, rollups
+// only hold aggregates.
+func (o Options) viewSQL(t Table) string {
+	r := t.rollup
+	group := strings.Join(r.group, ", ")
+	return fmt.Sprintf("SELECT %s, bucket AS ts, toDate(bucket) AS date, quantileState(%s)(v) AS val FROM ("+
+		"SELECT %s, toDateTime(intDiv(toUInt32(ts), %d) * %d) AS bucket, val AS v FROM %s.%s WHERE stale = 0"+
+		") GROUP BY %s, bucket",
+		group, formatQuantile(r.quantile), group, r.resolution, r.resolution, o.Database, o.LocalName(r.table), group)
+}
+
+// Spec decides which tables back a job table.
+type Spec struct {
+	Layout   Layout
+	Rollups  []Rollup
+	Quantile float64
+	// Tenants adds the tenant column identifying the series of each tenant
+	Tenants bool
+}
+
+// Retention is how long the samples of a table are kept, zero is forever.
+type Retention struct {
+	Raw    time.Duration
+	Rollup time.Duration
+}
+
+// ttl expires rows d after their date, in whole days as that is what the
+// partitions are made of.
+func ttl(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	days := int64((d + 24*time.Hour - 1) / (24 * time.Hour))
+	return fmt.Sprintf("date + toIntervalDay(%d)", days)
+}
+
+// Tables returns the tables backing the job table name, with TTLs set
+// according to the retention. The series table of the split layout is kept
+// forever, its rows are tiny.
+func (s Spec) Tables(name string, retention Retention) []Table {
+	tables := s.Layout.Tables(name)
+	if s.Tenants {
+		// the split samples table only has fingerprints, which include the tenant
+		t := &tables[0]
+		t.Columns = append(append([]Column(nil), t.Columns...), TenantColumn)
+	}
+	source := &tables[len(tables)-1]
+	source.TTL = ttl(retention.Raw)
+	for _, r := range s.Rollups {
+		t := RollupTable(*source, r, s.Quantile)
+		t.TTL = ttl(retention.Rollup)
+		tables = append(tables, t)
+	}
+	return tables
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go"
+	pro "github.com/prom2click/protocal"
+	"github.com/prom2click/schema"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// split layout: labels go to <table>_series once per series, samples to
+// <table> with just the series fingerprint
+var insertSeriesSQL = `INSERT INTO %s.%s (fingerprint, name, job, labels) VALUES (?, ?, ?, ?)`
+var insertTenantSeriesSQL = `INSERT INTO %s.%s (fingerprint, name, job, labels, tenant) VALUES (?, ?, ?, ?, ?)`
+var insertSplitSQL = `INSERT INTO %s.%s (fingerprint, val, ts, stale) VALUES (?, ?, ?, ?)`
+
+// seriesCache remembers the fingerprints a writer already wrote to the series
+// table. It is cleared when full, the series table collapses the duplicates
+// written afterwards.
+type seriesCache struct {
+	size int
+	seen map[uint64]struct{}
+}
+
+func newSeriesCache(size int) *seriesCache {
+	return &seriesCache{size: size, seen: make(map[uint64]struct{})}
+}
+
+func (c *seriesCache) has(fp uint64) bool {
+	_, ok := c.seen[fp]
+	return ok
+}
+
+func (c *seriesCache) add(fp uint64) {
+	if len(c.seen) >= c.size {
+		c.seen = make(map[uint64]struct{})
+	}
+	c.seen[fp] = struct{}{}
+}
+
+// writeSplit writes the series not seen before and then all samples.
+func (w *p2cWriter) writeSplit(reqs []*pro.K8sRequest) {
+	table := w.Table()
+
+	var fresh []*pro.K8sRequest
+	batch := make(map[uint64]bool)
+	for _, req := range reqs {
+		if w.series.has(req.Fingerprint) || batch[req.Fingerprint] {
+			continue
+		}
+		batch[req.Fingerprint] = true
+		fresh = append(fresh, req)
+	}
+
+	if len(fresh) > 0 {
+		query, tenants := insertSeriesSQL, w.conf.spec.Tenants
+		if tenants {
+			query = insertTenantSeriesSQL
+		}
+		err := w.insert(fmt.Sprintf(query, w.conf.ChDB, table+schema.SeriesSuffix), len(fresh), func(smt *sql.Stmt, i int) error {
+			req := fresh[i]
+			if tenants {
+				_, err := smt.Exec(req.Fingerprint, req.Name, req.Job, clickhouse.Array(req.Tags), req.Tenant)
+				return err
+			}
+			_, err := smt.Exec(req.Fingerprint, req.Name, req.Job, clickhouse.Array(req.Tags))
+			return err
+		})
+		// only remember series known to be written, a failed row fails the
+		// whole insert and every fresh series is retried with the next batch
+		if err == nil {
+			for _, req := range fresh {
+				w.series.add(req.Fingerprint)
+			}
+		}
+	}
+
+	w.insert(fmt.Sprintf(insertSplitSQL, w.conf.ChDB, table), len(reqs), func(smt *sql.Stmt, i int) error {
+		req := reqs[i]
+		_, err := smt.Exec(req.Fingerprint, req.Val, req.Ts, req.Stale)
+		return err
+	})
+}
+
+// quoteString renders s as a clickhouse string literal.
+func quoteString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, `'`, `\'`, -1) + "'"
+}
+
+// seriesCondition translates a matcher into a condition on the name column and
+// the "name=value" array column labels (labels of the series table, tags of
+// the wide samples table), with Prometheus semantics for empty values: a
+// missing label equals "".
+func seriesCondition(m *remote.LabelMatcher, labels string) string {
+	if m.Name == model.MetricNameLabel {
+		switch m.Type {
+		case remote.MatchType_EQUAL:
+			return fmt.Sprintf("name = %s", quoteString(m.Value))
+		case remote.MatchType_NOT_EQUAL:
+			return fmt.Sprintf("name != %s", quoteString(m.Value))
+		case remote.MatchType_REGEX_MATCH:
+			return fmt.Sprintf("match(name, %s) = 1", quoteString("^(?:"+m.Value+")$"))
+		case remote.MatchType_REGEX_NO_MATCH:
+			return fmt.Sprintf("match(name, %s) = 0", quoteString("^(?:"+m.Value+")$"))
+		}
+	}
+
+	present := fmt.Sprintf("arrayExists(x -> position(x, %s) = 1, %s)", quoteString(m.Name+"="), labels)
+	switch m.Type {
+	case remote.MatchType_EQUAL, remote.MatchType_NOT_EQUAL:
+		cond := fmt.Sprintf("has(%s, %s)", labels, quoteString(m.Name+"="+m.Value))
+		if m.Value == "" {
+			cond = "NOT " + present
+		}
+		if m.Type == remote.MatchType_NOT_EQUAL {
+			return "NOT (" + cond + ")"
+		}
+		return cond
+	case remote.MatchType_REGEX_MATCH, remote.MatchType_REGEX_NO_MATCH:
+		re := "^(?:" + m.Value + ")$"
+		cond := fmt.Sprintf("arrayExists(x -> match(x, %s), %s)", quoteString("^"+regexp.QuoteMeta(m.Name)+"=(?:"+m.Value+")$"), labels)
+		if matchesEmpty, err := regexp.MatchString(re, ""); err == nil && matchesEmpty {
+			cond = "(" + cond + " OR NOT " + present + ")"
+		}
+		if m.Type == remote.MatchType_REGEX_NO_MATCH {
+			return "NOT " + cond
+		}
+		return cond
+	}
+	return "1"
+}
+
+// tagsToLabels turns "name=value" tags back into sorted label pairs.
+func tagsToLabels(tags []string) []*remote.LabelPair {
+	labels := make([]*remote.LabelPair, 0, len(tags))
+	for _, t := range tags {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		labels = append(labels, &remote.LabelPair{Name: kv[0], Value: kv[1]})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// querySplit runs a remote read query against the split layout: the matchers
+// are resolved against the series table first, then the samples of the
+// matching fingerprints are fetched.
+func (r *p2cReader) querySplit(ctx context.Context, tenant string, q *remote.Query, step int64) (*remote.QueryResult, int, error) {
+	res := &remote.QueryResult{Timeseries: make([]*remote.TimeSeries, 0)}
+
+	if _, _, _, err := r.getTimePeriod(q, step); err != nil {
+		return nil, 0, err
+	}
+	tables := r.readTables(q.Matchers)
+	series := make(map[uint64]*remote.TimeSeries)
+	var fps []string
+	err := r.lookupSeries(ctx, tenant, tables, q.Matchers, func(fp uint64, tags []string) {
+		series[fp] = &remote.TimeSeries{Labels: tagsToLabels(tags)}
+		fps = append(fps, strconv.FormatUint(fp, 10))
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(fps) == 0 {
+		return res, 0, nil
+	}
+	if err = r.checkResult(len(fps), 0); err != nil {
+		return nil, 0, err
+	}
+
+	samplesSQL, err := r.splitSamplesSQL(q, step, tables, fps)
+	if err != nil {
+		return nil, 0, err
+	}
+	samplesSQL = fmt.Sprintf("SELECT * FROM (%s) ORDER BY fingerprint, t%s", samplesSQL, r.settingsSQL())
+
+	rows, err := r.db.DB().QueryContext(ctx, samplesSQL)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	rcount := 0
+	for rows.Next() {
+		var cnt, t, fp uint64
+		var value float64
+		var stale uint8
+		if err = rows.Scan(&cnt, &t, &fp, &value, &stale); err != nil {
+			return nil, rcount, err
+		}
+		rcount++
+		if err = r.checkResult(0, rcount); err != nil {
+			return nil, rcount, err
+		}
+		ts, ok := series[fp]
+		if !ok {
+			continue
+		}
+		if len(ts.Samples) == 0 {
+			res.Timeseries = append(res.Timeseries, ts)
+		}
+		ts.Samples = append(ts.Samples, &remote.Sample{Value: sampleValue(value, stale), TimestampMs: int64(t)})
+	}
+	return res, rcount, rows.Err()
+}
+
+// splitSamplesSQL returns the unordered query of the samples of the series
+// fps of tables in the split layout, with the columns CNT, t, fingerprint,
+// value and stale like samplesSQL.
+func (r *p2cReader) splitSamplesSQL(q *remote.Query, step int64, tables []string, fps []string) (string, error) {
+	tselectSQL, twhereSQL, rollup, err := r.getTimePeriod(q, step)
+	if err != nil {
+		return "", err
+	}
+	twhereSQL += fmt.Sprintf(" AND fingerprint IN (%s)", strings.Join(fps, ","))
+	return r.stepsSQL(tselectSQL, twhereSQL, rollup, "fingerprint", tables), nil
+}
+
+// lookupSeries calls fn once with the fingerprint and tags of every series of
+// tenant in the series tables of tables matching all matchers.
+func (r *p2cReader) lookupSeries(ctx context.Context, tenant string, tables []string, matchers []*remote.LabelMatcher, fn func(fp uint64, tags []string)) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	conds := []string{"1"}
+	if r.conf.spec.Tenants {
+		conds = append(conds, "tenant = "+quoteString(tenant))
+	}
+	for _, m := range matchers {
+		conds = append(conds, seriesCondition(m, "labels"))
+	}
+	seriesSQL := fmt.Sprintf("SELECT * FROM (%s)%s", unionSQL(tables, func(t string) string {
+		return fmt.Sprintf("SELECT fingerprint, any(labels) FROM %s.%s WHERE %s GROUP BY fingerprint",
+			r.conf.ChDB, r.tableName(t+schema.SeriesSuffix), strings.Join(conds, " AND "))
+	}), r.settingsSQL())
+
+	rows, err := r.db.DB().QueryContext(ctx, seriesSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	seen := make(map[uint64]bool)
+	for rows.Next() {
+		var fp uint64
+		var tags []string
+		if err = rows.Scan(&fp, &tags); err != nil {
+			return err
+		}
+		if !seen[fp] {
+			seen[fp] = true
+			fn(fp, tags)
+		}
+	}
+	return rows.Err()
+}
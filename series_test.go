@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// roundTrip is what is written and read back for a series.
+type roundTrip struct {
+	Case   string `json:"case"`
+	Layout string `json:"layout"`
+	// the promoted columns written
+	Name          string `json:"name"`
+	Job           string `json:"job"`
+	Containername string `json:"container_name"`
+	// the tags or labels array column written
+	Tags        []string `json:"tags"`
+	Fingerprint uint64   `json:"fingerprint"`
+	// the series read back
+	Series []*remote.TimeSeries `json:"series"`
+}
+
+var roundTripCases = []struct {
+	name   string
+	tenant string
+	labels []*remote.LabelPair
+}{
+	{
+		name: "kubernetes container",
+		labels: []*remote.LabelPair{
+			{Name: "__name__", Value: "container_cpu_usage_seconds_total"},
+			{Name: "namespace", Value: "default"},
+			{Name: "pod_name", Value: "api-0"},
+			{Name: "container_name", Value: "api"},
+			{Name: "job", Value: "kubernetes-cadvisor"},
+			{Name: "instance", Value: "10.0.0.1:4194"},
+		},
+	},
+	{
+		name: "values with separators",
+		labels: []*remote.LabelPair{
+			{Name: "job", Value: "api"},
+			{Name: "handler", Value: "/query?a=b&c=d"},
+			{Name: "__name__", Value: "http_requests_total"},
+			{Name: "code", Value: "200"},
+			{Name: "le", Value: "+Inf"},
+			{Name: "path", Value: "ümlaut=ü"},
+		},
+	},
+	{
+		name: "byte order of names",
+		labels: []*remote.LabelPair{
+			{Name: "ab", Value: "1"},
+			{Name: "a_b", Value: "2"},
+			{Name: "a", Value: "3"},
+			{Name: "__name__", Value: "up"},
+			{Name: "B", Value: "4"},
+			{Name: "_x", Value: "5"},
+		},
+	},
+	{
+		name:   "tenant",
+		tenant: "team-a",
+		labels: []*remote.LabelPair{
+			{Name: "__name__", Value: "up"},
+			{Name: "job", Value: "api"},
+		},
+	},
+	{
+		name: "no tenant",
+		labels: []*remote.LabelPair{
+			{Name: "__name__", Value: "up"},
+			{Name: "job", Value: "api"},
+		},
+	},
+}
+
+// fakeRow is a row of the fake tables of fakeTables: a sample of the wide
+// layout, or of the split layout and its series.
+type fakeRow struct {
+	tenant      string
+	tags        []string
+	fingerprint uint64
+	ts          int64
+	val         float64
+}
+
+var fakeTenant = regexp.MustCompile(`tenant = '([^']*)'`)
+
+// fakeTables answers the queries of the readers from rows like clickhouse:
+// the series of the split layout by fingerprint, and the samples of steps of
+// 10s grouped by step and tags or fingerprint. Matchers are ignored.
+func fakeTables(rows []fakeRow) fakeHandler {
+	return func(query string) ([]string, [][]driver.Value, error) {
+		tenant := ""
+		if m := fakeTenant.FindStringSubmatch(query); m != nil {
+			tenant = m[1]
+		}
+		var out [][]driver.Value
+		if strings.Contains(query, "_series") {
+			seen := make(map[uint64]bool)
+			for _, row := range rows {
+				if row.tenant == tenant && !seen[row.fingerprint] {
+					seen[row.fingerprint] = true
+					out = append(out, []driver.Value{row.fingerprint, row.tags})
+				}
+			}
+			return []string{"fingerprint", "any(labels)"}, out, nil
+		}
+
+		m := fakeTimeRange.FindStringSubmatch(query)
+		if m == nil {
+			return nil, nil, fmt.Errorf("no time range in %s", query)
+		}
+		from, _ := strconv.ParseInt(m[1], 10, 64)
+		to, _ := strconv.ParseInt(m[2], 10, 64)
+		split := strings.Contains(query, "fingerprint IN")
+		type group struct {
+			t    int64
+			s    interface{}
+			vals []float64
+		}
+		var groups []*group
+		index := make(map[string]*group)
+		for _, row := range rows {
+			if (row.tenant != tenant && !split) || row.ts < from || row.ts > to {
+				continue
+			}
+			s := interface{}(row.tags)
+			if split {
+				s = row.fingerprint
+			}
+			t := row.ts / 10 * 10 * 1000
+			key := fmt.Sprintf("%d %q", t, s)
+			g, ok := index[key]
+			if !ok {
+				g = &group{t: t, s: s}
+				index[key] = g
+				groups = append(groups, g)
+			}
+			g.vals = append(g.vals, row.val)
+		}
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].t < groups[j].t })
+		for _, g := range groups {
+			sort.Float64s(g.vals)
+			out = append(out, []driver.Value{uint64(len(g.vals)), uint64(g.t), g.s, g.vals[len(g.vals)-1], uint8(0)})
+		}
+		if split {
+			return []string{"CNT", "t", "fingerprint", "value", "stale"}, out, nil
+		}
+		return []string{"CNT", "t", "tags", "value", "stale"}, out, nil
+	}
+}
+
+// writeAndRead writes the samples of a series like process and the writers
+// do, with the labels as given at 1000s and 1010s and in reverse order at
+// 1005s, in the first step, and reads the series back through the reader of layout scanning
+// the rows of a fake clickhouse: the wide layout from the tags column of the
+// samples, the split layout from the labels column of the series table.
+func writeAndRead(t *testing.T, tenant string, labels []*remote.LabelPair, layout string) roundTrip {
+	split := layout == "split"
+	req := seriesRequest(tenant, labels, split)
+	reversed := make([]*remote.LabelPair, len(labels))
+	for i, l := range labels {
+		reversed[len(labels)-1-i] = l
+	}
+	rev := seriesRequest(tenant, reversed, split)
+	rows := []fakeRow{
+		{tenant: tenant, tags: append([]string(nil), req.Tags...), fingerprint: req.Fingerprint, ts: 1000, val: 1},
+		{tenant: tenant, tags: append([]string(nil), rev.Tags...), fingerprint: rev.Fingerprint, ts: 1005, val: 2},
+		{tenant: tenant, tags: append([]string(nil), req.Tags...), fingerprint: req.Fingerprint, ts: 1010, val: 3},
+	}
+
+	r := fakeReader(t, fakeTables(rows))
+	r.conf.ChLayout = layout
+	r.conf.spec.Tenants = tenant != ""
+	q := &remote.Query{
+		StartTimestampMs: 1000000,
+		EndTimestampMs:   1100000,
+		Matchers:         []*remote.LabelMatcher{{Type: remote.MatchType_EQUAL, Name: "__name__", Value: req.Name}},
+	}
+	res, _, err := r.Query(context.Background(), tenant, q, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roundTrip{
+		Layout:        layout,
+		Name:          req.Name,
+		Job:           req.Job,
+		Containername: req.Containername,
+		Tags:          req.Tags,
+		Fingerprint:   req.Fingerprint,
+		Series:        res.Timeseries,
+	}
+}
+
+func TestSeriesRoundTrip(t *testing.T) {
+	var got []roundTrip
+	keys := make(map[string]string)
+	for _, c := range roundTripCases {
+		for _, layout := range []string{"wide", "split"} {
+			rt := writeAndRead(t, c.tenant, c.labels, layout)
+			rt.Case = c.name
+			got = append(got, rt)
+
+			// the order the labels are written in does not matter: one
+			// series with one sample per step
+			if len(rt.Series) != 1 || len(rt.Series[0].Samples) != 2 || rt.Series[0].Samples[0].TimestampMs == rt.Series[0].Samples[1].TimestampMs {
+				t.Errorf("%s, %s layout: read %v, want one series with a sample in each of two steps", c.name, layout, rt.Series)
+				continue
+			}
+
+			// every label written is read back, sorted by name
+			want := make([]*remote.LabelPair, 0, len(c.labels))
+			for _, l := range c.labels {
+				want = append(want, &remote.LabelPair{Name: l.Name, Value: l.Value})
+			}
+			sort.Slice(want, func(i, j int) bool { return want[i].Name < want[j].Name })
+			if !reflect.DeepEqual(rt.Series[0].Labels, want) {
+				t.Errorf("%s, %s layout: read labels %v, want %v", c.name, layout, rt.Series[0].Labels, want)
+			}
+
+			// reads are per tenant, so keys only need to differ within one
+			key := labelsKey(rt.Series[0].Labels)
+			if other, ok := keys[c.tenant+"\xff"+key]; ok && other != c.name {
+				t.Errorf("%s and %s have the same series key", c.name, other)
+			}
+			keys[c.tenant+"\xff"+key] = c.name
+		}
+	}
+	up := roundTripCases[len(roundTripCases)-1].labels
+	if a, b := seriesRequest("team-a", up, true).Fingerprint, seriesRequest("", up, true).Fingerprint; a == 0 || a == b {
+		t.Errorf("split layout fingerprints must be set and differ between tenants")
+	}
+
+	golden := filepath.Join("testdata", "series_roundtrip.golden")
+	data, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+	if *update {
+		if err := ioutil.WriteFile(golden, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%s, run go test -update to create it", err)
+	}
+	if string(data) != string(want) {
+		t.Errorf("round trip differs from %s, run go test -update and review the diff:\n%s", golden, data)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// splitBase is where the split intervals are counted from: monday
+// 1970-01-05 00:00 UTC, so week long intervals match the toMonday(date)
+// partitions of the samples tables.
+const splitBase = 4 * 24 * 3600
+
+// runSplit runs a query that passed checkQuery, split into sub-queries of
+// at most ReadSplitInterval that run in parallel. The sub-queries share the
+// step of the whole query and are cut at step boundaries, so no step is
+// aggregated twice, and the per-series samples are merged in order.
+func (r *p2cReader) runSplit(ctx context.Context, tenant string, q *remote.Query, step int64) (*remote.QueryResult, int, error) {
+	interval := int64(r.conf.ReadSplitInterval / time.Second)
+	tstart, tend := q.StartTimestampMs/1000, q.EndTimestampMs/1000
+	if interval <= 0 || tend < tstart || tend-tstart <= interval {
+		return r.run(ctx, tenant, q, step)
+	}
+	if step == 0 {
+		step = r.defaultStep(tstart, tend)
+	}
+	step, _ = r.getStep(step)
+
+	bounds := []int64{tstart}
+	for b := (tstart-splitBase)/interval*interval + splitBase + interval; b <= tend; b += interval {
+		if b := b / step * step; b > bounds[len(bounds)-1] {
+			bounds = append(bounds, b)
+		}
+	}
+	if len(bounds) == 1 {
+		return r.run(ctx, tenant, q, step)
+	}
+
+	parts := make([]*remote.QueryResult, len(bounds))
+	err := r.parallel(ctx, len(bounds), func(ctx context.Context, i int) error {
+		sub := &remote.Query{StartTimestampMs: bounds[i] * 1000, EndTimestampMs: q.EndTimestampMs, Matchers: q.Matchers}
+		if i == 0 {
+			sub.StartTimestampMs = q.StartTimestampMs
+		}
+		if i+1 < len(bounds) {
+			// the where clause includes the end second
+			sub.EndTimestampMs = (bounds[i+1] - 1) * 1000
+		}
+		var err error
+		parts[i], _, err = r.run(ctx, tenant, sub, step)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, n := mergeResults(parts, q.StartTimestampMs/1000/step*step*1000, q.EndTimestampMs)
+	if err := r.checkResult(len(res.Timeseries), n); err != nil {
+		return nil, n, err
+	}
+	return res, n, nil
+}
@@ -3,6 +3,11 @@ package main
 import (
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	"fmt"
@@ -11,21 +16,40 @@ import (
 	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	promconfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/relabel"
 	"github.com/prometheus/prometheus/storage/remote"
 	"gopkg.in/tylerb/graceful.v1"
 	tag "github.com/prom2click/label"
 	pro "github.com/prom2click/protocal"
+	cfg "github.com/prom2click/config"
+	"github.com/prom2click/database"
 	"github.com/prom2click/job"
+	"github.com/prom2click/schema"
 )
 
 type p2cServer struct {
 	requests chan *pro.K8sRequest
 	mux      *http.ServeMux
 	conf     *config
-	writers  []*p2cWriter
+	writers  map[string]*p2cWriter
 	reader   *p2cReader
+	engine   *promql.Engine
+	metadata *metadataCache
 	jm       *job.JobManager
-	rx       prometheus.Counter
+	rx       *prometheus.CounterVec
+	reads    *prometheus.CounterVec
+	dropped  *prometheus.CounterVec
+	unrouted *unroutedTracker
+	limits   *cardinalityLimiter
+	ha       *haTracker
+	fallback chan *pro.K8sRequest
+	reloadCh chan chan error
+	auth     *authenticator
+	tls      *webTLS
+	reloadOK prometheus.Gauge
+	reloadTS prometheus.Gauge
 }
 
 func NewP2CServer(conf *config) (*p2cServer, error) {
@@ -34,26 +58,62 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 	c.requests = make(chan *pro.K8sRequest, conf.ChanSize)
 	c.mux = http.NewServeMux()
 	c.conf = conf
+	if conf.WebConfigFile != "" {
+		if c.tls, err = newWebTLS(conf.WebConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	if conf.HTTPAuthFile != "" {
+		if c.auth, err = newAuthenticator(conf.HTTPAuthFile); err != nil {
+			return nil, err
+		}
+	}
+
+	checker, err := newSchemaChecker(conf)
+	if err != nil {
+		return nil, err
+	}
 
 	//Initial JobManager ..
-	jm, err := job.NewJobManager(c.conf.ChBatch)
+	jm, err := job.NewJobManager(c.conf.ChBatch, checker.Validate)
 	if err != nil {
 		return nil, err
 	}
 	c.jm = jm
-	//根据不同的job生成不同的writer，每个writer都有自己监控的channel，channel中的值由server分发
-	for jobname, channel := range c.jm.GetJobs() {
-		table := c.jm.GetTableAccordingJobName(jobname)
-		if table == "" {
-			fmt.Println("Error find table according jobname in configfile")
-			continue
+	c.writers = make(map[string]*p2cWriter)
+	if err = c.syncWriters(c.jm.Snapshot()); err != nil {
+		return nil, err
+	}
+	c.jm.Subscribe(func(snap *cfg.Snapshot) {
+		if err := c.syncWriters(snap); err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+	})
+
+	c.unrouted = newUnroutedTracker()
+	c.limits = newCardinalityLimiter(conf.LimitsMaxLabels, conf.LimitsMaxTenantSeries, conf.LimitsMaxTracked, conf.LimitsIdleTimeout)
+	c.limits.Start()
+	if conf.HAReplicaLabel != "" {
+		c.ha = newHATracker(conf.HAClusterLabel, conf.HAReplicaLabel, conf.HATimeout)
+	}
+	if conf.WriteUnrouted == unroutedFallback {
+		if err = checker.CheckTable(conf.FallbackTable); err != nil {
+			return nil, fmt.Errorf("fallback table: %s", err)
 		}
-		writer, err := NewP2CWriter(conf, jobname, table, channel)
+		c.fallback = make(chan *pro.K8sRequest, conf.ChBatch)
+		writer, err := newP2CWriter(conf, "<fallback>", conf.FallbackTable, c.fallback)
 		if err != nil {
-			fmt.Printf("Error creating clickhouse writer: %s\n", err.Error())
+			return nil, fmt.Errorf("creating clickhouse writer for fallback table: %s", err)
 		}
 		writer.Start()
-		c.writers = append(c.writers, writer)
+	}
+
+	if conf.JanitorInterval > 0 {
+		janitor, err := newJanitor(conf, jm)
+		if err != nil {
+			return nil, fmt.Errorf("creating janitor: %s", err)
+		}
+		janitor.Start(conf.JanitorInterval)
 	}
 
 	c.reader, err = NewP2CReader(conf,jm)
@@ -62,15 +122,47 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 		return c, err
 	}
 
-	c.rx = prometheus.NewCounter(
+	c.rx = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "received_samples_total",
-			Help: "Total number of received samples.",
+			Help: "Total number of received samples, by tenant.",
+		},
+		[]string{"tenant"},
+	)
+	c.reads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "read_queries_total",
+			Help: "Total number of remote read queries, by tenant.",
+		},
+		[]string{"tenant"},
+	)
+	c.dropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "relabel_dropped_samples_total",
+			Help: "Total number of received samples dropped by the relabel configs of their job.",
 		},
+		[]string{"job"},
 	)
-	prometheus.MustRegister(c.rx)
+	prometheus.MustRegister(c.rx, c.reads, c.dropped)
 
-	c.mux.HandleFunc(c.conf.HTTPWritePath, func(w http.ResponseWriter, r *http.Request) {
+	c.reloadOK = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		},
+	)
+	c.reloadTS = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		},
+	)
+	prometheus.MustRegister(c.reloadOK, c.reloadTS)
+	c.reloadOK.Set(1)
+	c.reloadTS.SetToCurrentTime()
+	c.reloadCh = make(chan chan error)
+
+	c.withTenant(permWrite, c.conf.HTTPWritePath, func(tenant string, w http.ResponseWriter, r *http.Request) {
 		//close the body ..
 		defer r.Body.Close()
 
@@ -92,10 +184,13 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 			return
 		}
 
-		c.process(req)
+		if err := c.process(tenant, req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	})
 
-	c.mux.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
+	c.withTenant(permRead, "/read", func(tenant string, w http.ResponseWriter, r *http.Request) {
 		//close the body ..
 		defer r.Body.Close()
 
@@ -119,8 +214,12 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 		start := time.Now()
 		fmt.Printf("the query stars at the time %v\n", start)
 		var resp *remote.ReadResponse
-		resp, err = c.reader.Read(&req)
-		if err != nil {
+		c.reads.WithLabelValues(tenant).Add(float64(len(req.Queries)))
+		resp, err = c.reader.Read(r.Context(), tenant, &req)
+		if _, ok := err.(*queryLimitError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -144,6 +243,34 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 
 	})
 
+	// prometheus HTTP API, eg. for grafana
+	c.engine = promql.NewEngine(p2cQueryable{reader: c.reader}, &promql.EngineOptions{
+		MaxConcurrentQueries: conf.APIMaxConcurrency,
+		Timeout:              conf.APIQueryTimeout,
+	})
+	c.withTenant(permRead, "/api/v1/query", c.serveQuery)
+	c.withTenant(permRead, "/api/v1/query_range", c.serveQueryRange)
+	c.metadata = newMetadataCache(conf.APIMetadataCacheTTL)
+	c.withTenant(permRead, "/api/v1/labels", c.serveLabels)
+	c.withTenant(permRead, "/api/v1/series", c.serveSeries)
+	c.handle(permRead, "/api/v1/label/", http.HandlerFunc(c.serveLabelValues))
+
+	c.handle(permAdmin, "/-/reload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		errc := make(chan error)
+		c.reloadCh <- errc
+		if err := <-errc; err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+		}
+	}))
+
+	c.handle(permAdmin, "/debug/unrouted", c.unrouted)
+	c.handle(permAdmin, "/debug/cardinality", c.limits)
+
 	c.mux.Handle(c.conf.HTTPMetricsPath, prometheus.InstrumentHandler(
 		c.conf.HTTPMetricsPath, prometheus.UninstrumentedHandler(),
 	))
@@ -151,53 +278,299 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 	return c, nil
 }
 
-func (c *p2cServer) process(req remote.WriteRequest) {
-	for _, series := range req.Timeseries {
-		c.rx.Add(float64(len(series.Samples)))
-		p2c := pro.NewK8sRequest()
-		for _, label := range series.Labels {
-			if model.LabelName(label.Name) == model.MetricNameLabel {
-				p2c.Name = label.Value
-			}
-			if model.LabelName(label.Name) == model.JobLabel {
-				p2c.Job = label.Value
-			}
-			if model.LabelName(label.Name) == tag.Namespace {
-				p2c.Namespace = label.Value
+//根据不同的job生成不同的writer，每个writer都有自己监控的channel，channel中的值由server分发
+//writer自己订阅配置变化，job被移除时自行退出；这里只负责为新job启动writer
+//只在启动时和配置订阅回调中调用，不会并发执行
+func (c *p2cServer) syncWriters(snap *cfg.Snapshot) error {
+	jobmap := snap.JobMap()
+	for jobname := range c.writers {
+		if _, ok := jobmap[jobname]; !ok {
+			delete(c.writers, jobname)
+		}
+	}
+	for jobname := range jobmap {
+		if _, ok := c.writers[jobname]; ok {
+			continue
+		}
+		writer, err := NewP2CWriter(c.conf, jobname, c.jm)
+		if err != nil {
+			return fmt.Errorf("creating clickhouse writer for job %q: %s", jobname, err)
+		}
+		writer.Start()
+		c.writers[jobname] = writer
+	}
+	return nil
+}
+
+// handle registers h for path, only reachable with perm if auth is enabled.
+func (c *p2cServer) handle(perm, path string, h http.Handler) {
+	if c.auth != nil {
+		h = c.auth.require(perm, h)
+	}
+	c.mux.Handle(path, h)
+}
+
+// reload applies the config file and the auth file, the job manager and
+// writers follow through their subscriptions. Both files are read and
+// checked before either is applied, so a reload failing on one of them
+// changes nothing. It is only called from handleReloads so reloads never run
+// concurrently.
+func (c *p2cServer) reload() error {
+	cfg, err := c.jm.ReadConfig()
+	if err != nil {
+		c.reloadOK.Set(0)
+		return err
+	}
+	var creds *authFile
+	if c.auth != nil {
+		if creds, err = c.auth.read(); err != nil {
+			c.reloadOK.Set(0)
+			return err
+		}
+	}
+	c.jm.Apply(cfg)
+	if c.auth != nil {
+		c.auth.apply(creds)
+	}
+	c.reloadOK.Set(1)
+	c.reloadTS.SetToCurrentTime()
+	return nil
+}
+
+// handleReloads serializes reload requests coming from SIGHUP and /-/reload.
+func (c *p2cServer) handleReloads() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-hup:
+			if err := c.reload(); err != nil {
+				fmt.Printf("Error: reloading config: %s\n", err)
+			} else {
+				fmt.Println("Config reloaded..")
 			}
-			if model.LabelName(label.Name) == tag.Ip {
-				p2c.Ip = label.Value
+		case errc := <-c.reloadCh:
+			err := c.reload()
+			if err != nil {
+				fmt.Printf("Error: reloading config: %s\n", err)
+			} else {
+				fmt.Println("Config reloaded..")
 			}
-			if model.LabelName(label.Name) == tag.App {
-				p2c.App = label.Value
+			errc <- err
+		}
+	}
+}
+
+// newSchemaChecker connects to clickhouse for verifying the job tables on
+// startup and on every config reload.
+func newSchemaChecker(conf *config) (*schema.Checker, error) {
+	db, err := database.Open(conf.dsn, 2, 1)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to clickhouse: %s", err)
+	}
+	return schema.NewChecker(db, conf.ChDB, conf.spec), nil
+}
+
+func (c *p2cServer) process(tenant string, req remote.WriteRequest) error {
+	if c.ha != nil {
+		req.Timeseries = c.ha.filter(tenant, req.Timeseries)
+	}
+
+	if c.conf.WriteUnrouted == unroutedReject {
+		if err := c.rejectUnrouted(req); err != nil {
+			return err
+		}
+	}
+
+	snap := c.jm.Snapshot()
+	now := time.Now()
+	// series over a limit are skipped, the rest of the request is written
+	var limitErr error
+	for _, series := range req.Timeseries {
+		c.rx.WithLabelValues(tenant).Add(float64(len(series.Samples)))
+
+		// series are routed by their original job, relabeling happens after
+		jobname := jobOf(series.Labels)
+		labels := series.Labels
+		if cfgs := snap.Relabel(jobname); len(cfgs) > 0 {
+			if labels = relabelSeries(labels, cfgs); labels == nil {
+				c.dropped.WithLabelValues(jobname).Add(float64(len(series.Samples)))
+				continue
 			}
-			if model.LabelName(label.Name) == tag.Shard {
-				p2c.Shard = label.Value
+		}
+
+		p2c := seriesRequest(tenant, labels, schema.Layout(c.conf.ChLayout) == schema.LayoutSplit)
+		if reason := c.admit(snap, tenant, jobname, p2c, len(labels), now); reason != "" {
+			c.limits.discard(tenant, jobname, reason, len(series.Samples))
+			if c.conf.LimitsAction == limitReject && limitErr == nil {
+				limitErr = fmt.Errorf("series %s of job %q exceeds the %s limit", p2c.Name, jobname, reason)
 			}
-			if model.LabelName(label.Name) == tag.Keyspace {
-				p2c.Keyspace = label.Value
+			continue
+		}
+
+		unrouted := 0
+		for _, sample := range series.Samples {
+			// each sample needs its own request, the writer holds on to them
+			s := *p2c
+			s.Ts = time.Unix(sample.TimestampMs/1000, 0)
+			s.Val = sample.Value
+			if pro.IsStaleNaN(sample.Value) {
+				// kept bit-exact in val and flagged, reads skip it in aggregates
+				s.Stale = 1
 			}
-			if model.LabelName(label.Name) == tag.Component {
-				p2c.Component = label.Value
+			if err := c.jm.Send(jobname, &s); err == nil {
+				continue
 			}
-			if model.LabelName(label.Name) == tag.Container {
-				p2c.Containername = label.Value
+			unrouted++
+			if c.fallback != nil {
+				c.fallback <- &s
 			}
+		}
+		if unrouted > 0 {
+			c.unrouted.record(jobname, c.conf.WriteUnrouted, unrouted)
+		}
+	}
+	return limitErr
+}
 
-			t := fmt.Sprintf("%s=%s", label.Name, label.Value)
-			p2c.Tags = append(p2c.Tags, t)
+// seriesRequest returns the request the samples of a series with labels are
+// written with: every label as a "name=value" tag, sorted so a series has
+// the same tags whatever order its labels come in, and the promoted labels
+// in their columns too. The split layout also needs the fingerprint.
+func seriesRequest(tenant string, labels []*remote.LabelPair, split bool) *pro.K8sRequest {
+	p2c := pro.NewK8sRequest()
+	p2c.Tenant = tenant
+	for _, label := range labels {
+		if model.LabelName(label.Name) == model.MetricNameLabel {
+			p2c.Name = label.Value
 		}
-		for _, sample := range series.Samples {
-			p2c.Ts = time.Unix(sample.TimestampMs/1000, 0)
-			p2c.Val = sample.Value
-			if channel, err := c.jm.GetChannelAccordingJobname(p2c.Job); err == nil {
-				channel <- p2c
-			}
+		if model.LabelName(label.Name) == model.JobLabel {
+			p2c.Job = label.Value
+		}
+		if model.LabelName(label.Name) == tag.Namespace {
+			p2c.Namespace = label.Value
+		}
+		if model.LabelName(label.Name) == tag.Ip {
+			p2c.Ip = label.Value
+		}
+		if model.LabelName(label.Name) == tag.App {
+			p2c.App = label.Value
+		}
+		if model.LabelName(label.Name) == tag.Shard {
+			p2c.Shard = label.Value
+		}
+		if model.LabelName(label.Name) == tag.Keyspace {
+			p2c.Keyspace = label.Value
 		}
+		if model.LabelName(label.Name) == tag.Component {
+			p2c.Component = label.Value
+		}
+		if model.LabelName(label.Name) == tag.Container {
+			p2c.Containername = label.Value
+		}
+
+		t := fmt.Sprintf("%s=%s", label.Name, label.Value)
+		p2c.Tags = append(p2c.Tags, t)
+	}
+	sort.Strings(p2c.Tags)
+	if split {
+		p2c.Fingerprint = pro.Fingerprint(tenant, p2c.Tags)
+	}
+	return p2c
+}
+
+// admit checks a series against the cardinality limits of its job, returning
+// the reason it must be discarded or "".
+func (c *p2cServer) admit(snap *cfg.Snapshot, tenant, jobname string, req *pro.K8sRequest, nlabels int, now time.Time) string {
+	maxSeries := c.conf.LimitsMaxSeries
+	j, ok := snap.Job(jobname)
+	if !ok {
+		// unrouted series are only written with a fallback table
+		if c.fallback == nil {
+			return ""
+		}
+		jobname = cardinalityUnrouted
+	} else if j.MaxSeries > 0 {
+		maxSeries = j.MaxSeries
+	}
+	fingerprint := req.Fingerprint
+	if schema.Layout(c.conf.ChLayout) != schema.LayoutSplit {
+		fingerprint = pro.Fingerprint(tenant, req.Tags)
+	}
+	return c.limits.admit(tenant, jobname, maxSeries, req.Name, fingerprint, nlabels, now)
+}
+
+// jobOf returns the job label of a series, "x" like NewK8sRequest if it has
+// none.
+func jobOf(labels []*remote.LabelPair) string {
+	for _, label := range labels {
+		if model.LabelName(label.Name) == model.JobLabel {
+			return label.Value
+		}
+	}
+	return pro.NewK8sRequest().Job
+}
+
+// relabelSeries applies the relabel configs to the labels of a series and
+// returns the result sorted by name, or nil if the series was dropped.
+func relabelSeries(labels []*remote.LabelPair, cfgs []*promconfig.RelabelConfig) []*remote.LabelPair {
+	ls := make(model.LabelSet, len(labels))
+	for _, l := range labels {
+		ls[model.LabelName(l.Name)] = model.LabelValue(l.Value)
 	}
+	ls = relabel.Process(ls, cfgs...)
+	if ls == nil {
+		return nil
+	}
+
+	out := make([]*remote.LabelPair, 0, len(ls))
+	for name, value := range ls {
+		// like prometheus, an empty value is the same as no label
+		if value == "" {
+			continue
+		}
+		out = append(out, &remote.LabelPair{Name: string(name), Value: string(value)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// rejectUnrouted fails the whole request if any series belongs to a job
+// missing from the job config, so nothing of it gets written.
+func (c *p2cServer) rejectUnrouted(req remote.WriteRequest) error {
+	snap := c.jm.Snapshot()
+	var unknown []string
+	seen := make(map[string]bool)
+	for _, series := range req.Timeseries {
+		jobname := jobOf(series.Labels)
+		if _, ok := snap.Table(jobname); ok {
+			continue
+		}
+		c.unrouted.record(jobname, unroutedReject, len(series.Samples))
+		if !seen[jobname] {
+			seen[jobname] = true
+			unknown = append(unknown, jobname)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("no job config entry for job(s): %s", strings.Join(unknown, ", "))
+	}
+	return nil
 }
 
 func (c *p2cServer) Start() error {
-	fmt.Println("HTTP server starting...")
-	return graceful.RunWithErr(c.conf.HTTPAddr, c.conf.HTTPTimeout, c.mux)
+	go c.handleReloads()
+	if c.tls == nil {
+		fmt.Println("HTTP server starting...")
+		return graceful.RunWithErr(c.conf.HTTPAddr, c.conf.HTTPTimeout, c.mux)
+	}
+
+	fmt.Println("HTTPS server starting...")
+	srv := &graceful.Server{
+		Timeout:      c.conf.HTTPTimeout,
+		TCPKeepAlive: 3 * time.Minute,
+		Server:       &http.Server{Addr: c.conf.HTTPAddr, Handler: c.mux},
+		Logger:       graceful.DefaultLogger(),
+	}
+	return srv.ListenAndServeTLSConfig(c.tls.TLSConfig())
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// readTables returns the tables holding the series matching matchers: the
+// tables of the configured jobs the job matchers select, plus the fallback
+// table when series of unconfigured jobs may match too. __name__ does not
+// narrow the tables down, any job table may hold any metric.
+func (r *p2cReader) readTables(matchers []*remote.LabelMatcher) []string {
+	snap := r.jm.Snapshot()
+	fallback := r.conf.WriteUnrouted == unroutedFallback && r.conf.FallbackTable != ""
+
+	var jobMatchers []*remote.LabelMatcher
+	for _, m := range matchers {
+		if m.Name == string(model.JobLabel) {
+			jobMatchers = append(jobMatchers, m)
+		}
+	}
+	matches := func(job string) bool {
+		for _, m := range jobMatchers {
+			if !matchValue(m, job) {
+				return false
+			}
+		}
+		return true
+	}
+
+	seen := make(map[string]bool)
+	var tables []string
+	add := func(table string) {
+		if !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	for _, m := range jobMatchers {
+		if m.Type != remote.MatchType_EQUAL {
+			continue
+		}
+		// a single job, either configured or written to the fallback table
+		if !matches(m.Value) {
+			return nil
+		}
+		if table, ok := snap.Table(m.Value); ok {
+			return []string{table}
+		}
+		if fallback {
+			return []string{r.conf.FallbackTable}
+		}
+		return nil
+	}
+	for job, table := range snap.JobMap() {
+		if matches(job) {
+			add(table)
+		}
+	}
+	if fallback {
+		add(r.conf.FallbackTable)
+	}
+	if len(snap.JobMap()) == 0 {
+		add(r.conf.ChTable)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// readTablesOf returns the tables holding the series matching any of the
+// selectors, or all tables without selectors.
+func (r *p2cReader) readTablesOf(selectors [][]*remote.LabelMatcher) []string {
+	if len(selectors) == 0 {
+		return r.readTables(nil)
+	}
+	seen := make(map[string]bool)
+	var tables []string
+	for _, sel := range selectors {
+		for _, t := range r.readTables(sel) {
+			if !seen[t] {
+				seen[t] = true
+				tables = append(tables, t)
+			}
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// tableName returns the name reads use for table, which is one of the
+// tables of a job, its series table or one of its rollups: the local table
+// behind it with -read.local-tables.
+func (r *p2cReader) tableName(table string) string {
+	if r.conf.ReadLocalTables && r.conf.SchemaDistributed {
+		return table + r.conf.SchemaLocalSuffix
+	}
+	return table
+}
+
+// unionSQL returns query of every table, concatenated with UNION ALL.
+func unionSQL(tables []string, query func(table string) string) string {
+	queries := make([]string, 0, len(tables))
+	for _, t := range tables {
+		queries = append(queries, query(t))
+	}
+	return strings.Join(queries, " UNION ALL ")
+}
+
+// matchValue reports whether m matches the label value v.
+func matchValue(m *remote.LabelMatcher, v string) bool {
+	switch m.Type {
+	case remote.MatchType_EQUAL:
+		return m.Value == v
+	case remote.MatchType_NOT_EQUAL:
+		return m.Value != v
+	}
+	ok, _ := regexp.MatchString("^(?:"+m.Value+")$", v)
+	if m.Type == remote.MatchType_REGEX_NO_MATCH {
+		return !ok
+	}
+	return ok
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// tenant ids are stored in clickhouse and used as metric labels
+var tenantRE = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{1,128}$`)
+
+var errNoTenant = errors.New("no tenant id")
+
+// tenantOf returns the tenant of a request to base: the path below base
+// (eg. /write/team-a), the tenant header or the default tenant, in that
+// order. It returns "" if tenants are disabled.
+func (c *p2cServer) tenantOf(r *http.Request, base string) (string, error) {
+	if !c.conf.spec.Tenants {
+		return "", nil
+	}
+
+	tenant := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, base), "/")
+	if tenant == "" {
+		tenant = r.Header.Get(c.conf.TenantHeader)
+	}
+	if tenant == "" {
+		tenant = c.conf.TenantDefault
+	}
+	if tenant == "" {
+		return "", errNoTenant
+	}
+	if !tenantRE.MatchString(tenant) {
+		return "", fmt.Errorf("invalid tenant id %q", tenant)
+	}
+	return tenant, nil
+}
+
+// withTenant registers handler requiring perm for path and, with tenants
+// enabled, for the tenant ids below it. Requests without a valid tenant, or
+// for a tenant their credential is not allowed to use, are rejected.
+func (c *p2cServer) withTenant(perm, path string, handler func(tenant string, w http.ResponseWriter, r *http.Request)) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := c.tenantOf(r, path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !c.allowTenant(perm, tenant, w, r) {
+			return
+		}
+		handler(tenant, w, r)
+	})
+	c.handle(perm, path, h)
+	if c.conf.spec.Tenants {
+		c.handle(perm, strings.TrimSuffix(path, "/")+"/", h)
+	}
+}
+
+// allowTenant rejects the request with a 403 if its credential may not use
+// tenant.
+func (c *p2cServer) allowTenant(perm, tenant string, w http.ResponseWriter, r *http.Request) bool {
+	cred := credentialOf(r)
+	if cred == nil || !c.conf.spec.Tenants || cred.allowedTenant(tenant) {
+		return true
+	}
+	c.auth.failures.WithLabelValues(perm).Inc()
+	http.Error(w, fmt.Sprintf("%s is not allowed to use tenant %q", cred.Name, tenant), http.StatusForbidden)
+	return false
+}
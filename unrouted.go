@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// what to do with series whose job has no entry in the job config
+const (
+	unroutedDrop     = "drop"
+	unroutedFallback = "fallback"
+	unroutedReject   = "reject"
+)
+
+const (
+	// maximum number of distinct unrouted job names remembered
+	unroutedMaxJobs = 1000
+	// unrouted jobs not seen for this long are forgotten
+	unroutedWindow = time.Hour
+	// number of jobs listed on the debug page
+	unroutedTopN = 50
+)
+
+type unroutedJob struct {
+	name     string
+	samples  uint64
+	lastSeen time.Time
+}
+
+// unroutedTracker accounts for samples of jobs missing from the job config so
+// missing entries can be spotted on /debug/unrouted and in metrics.
+type unroutedTracker struct {
+	mu      sync.Mutex
+	jobs    map[string]*unroutedJob
+	samples *prometheus.CounterVec
+}
+
+func newUnroutedTracker() *unroutedTracker {
+	t := &unroutedTracker{
+		jobs: make(map[string]*unroutedJob),
+		samples: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "unrouted_samples_total",
+				Help: "Total number of received samples whose job is not in the job config, by job and action taken.",
+			},
+			[]string{"job", "action"},
+		),
+	}
+	prometheus.MustRegister(t.samples)
+	return t
+}
+
+func (t *unroutedTracker) record(job, action string, n int) {
+	t.samples.WithLabelValues(job, action).Add(float64(n))
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[job]
+	if !ok {
+		if len(t.jobs) >= unroutedMaxJobs {
+			t.evict(now)
+		}
+		j = &unroutedJob{name: job}
+		t.jobs[job] = j
+	}
+	j.samples += uint64(n)
+	j.lastSeen = now
+}
+
+// evict forgets jobs outside the window, or the least recently seen one if
+// that does not free any space. Must be called with mu held.
+func (t *unroutedTracker) evict(now time.Time) {
+	var oldest *unroutedJob
+	for name, j := range t.jobs {
+		if now.Sub(j.lastSeen) > unroutedWindow {
+			delete(t.jobs, name)
+			continue
+		}
+		if oldest == nil || j.lastSeen.Before(oldest.lastSeen) {
+			oldest = j
+		}
+	}
+	if len(t.jobs) >= unroutedMaxJobs && oldest != nil {
+		delete(t.jobs, oldest.name)
+	}
+}
+
+// top returns the recently seen unrouted jobs with the most samples first.
+func (t *unroutedTracker) top(n int) []unroutedJob {
+	now := time.Now()
+	t.mu.Lock()
+	jobs := make([]unroutedJob, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		if now.Sub(j.lastSeen) <= unroutedWindow {
+			jobs = append(jobs, *j)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].samples > jobs[b].samples })
+	if len(jobs) > n {
+		jobs = jobs[:n]
+	}
+	return jobs
+}
+
+func (t *unroutedTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	jobs := t.top(unroutedTopN)
+	fmt.Fprintf(w, "Top %d jobs without a job config entry seen in the last %s:\n\n", len(jobs), unroutedWindow)
+	fmt.Fprintf(w, "%-40s %12s  %s\n", "JOB", "SAMPLES", "LAST SEEN")
+	for _, j := range jobs {
+		fmt.Fprintf(w, "%-40s %12d  %s\n", j.name, j.samples, j.lastSeen.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the -web.config.file, in the format of the Prometheus
+// exporter-toolkit.
+type webConfig struct {
+	TLSConfig *tlsServerConfig `yaml:"tls_server_config"`
+}
+
+type tlsServerConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	MinVersion     string `yaml:"min_version"`
+	MaxVersion     string `yaml:"max_version"`
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// webNextProtos are the protocols offered over TLS, net/http only serves
+// HTTP/2 if the config of the server offers h2 too
+var webNextProtos = []string{"h2", "http/1.1"}
+
+var tlsVersions = map[string]uint16{
+	"":      0,
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// webTLS serves the TLS config of the web config file. The file and the
+// certificates it points to are re-read when they change, so certificates
+// can be rotated without a restart.
+type webTLS struct {
+	file string
+
+	mu      sync.Mutex
+	config  *tls.Config
+	mtimes  map[string]time.Time
+	checked time.Time
+}
+
+// newWebTLS loads the web config file. It returns nil if the file does not
+// configure TLS.
+func newWebTLS(file string) (*webTLS, error) {
+	w := &webTLS{file: file}
+	config, mtimes, err := w.load()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+	w.config, w.mtimes, w.checked = config, mtimes, time.Now()
+	return w, nil
+}
+
+// load reads the web config file and the files it references.
+func (w *webTLS) load() (*tls.Config, map[string]time.Time, error) {
+	mtimes := make(map[string]time.Time)
+	read := func(file string) ([]byte, error) {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		mtimes[file] = fi.ModTime()
+		return ioutil.ReadFile(file)
+	}
+
+	data, err := read(w.file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading web config: %s", err)
+	}
+	var wc webConfig
+	if err = yaml.Unmarshal(data, &wc); err != nil {
+		return nil, nil, fmt.Errorf("parsing web config %s: %s", w.file, err)
+	}
+	c := wc.TLSConfig
+	if c == nil {
+		return nil, mtimes, nil
+	}
+
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, nil, fmt.Errorf("web config %s: tls_server_config needs a cert_file and a key_file", w.file)
+	}
+	certPEM, err := read(c.CertFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("web config %s: %s", w.file, err)
+	}
+	keyPEM, err := read(c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("web config %s: %s", w.file, err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("web config %s: loading certificate: %s", w.file, err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   webNextProtos,
+	}
+	var ok bool
+	if config.ClientAuth, ok = tlsClientAuthTypes[c.ClientAuthType]; !ok {
+		return nil, nil, fmt.Errorf("web config %s: invalid client_auth_type %q", w.file, c.ClientAuthType)
+	}
+	if config.MinVersion, ok = tlsVersions[c.MinVersion]; !ok {
+		return nil, nil, fmt.Errorf("web config %s: invalid min_version %q", w.file, c.MinVersion)
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if config.MaxVersion, ok = tlsVersions[c.MaxVersion]; !ok {
+		return nil, nil, fmt.Errorf("web config %s: invalid max_version %q", w.file, c.MaxVersion)
+	}
+
+	if c.ClientCAFile != "" {
+		caPEM, err := read(c.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("web config %s: %s", w.file, err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, nil, fmt.Errorf("web config %s: no certificates in client_ca_file %s", w.file, c.ClientCAFile)
+		}
+	} else if config.ClientAuth == tls.VerifyClientCertIfGiven || config.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil, nil, fmt.Errorf("web config %s: client_auth_type %s needs a client_ca_file", w.file, c.ClientAuthType)
+	}
+
+	return config, mtimes, nil
+}
+
+// changed reports whether any of the loaded files was modified.
+func (w *webTLS) changed() bool {
+	for file, mtime := range w.mtimes {
+		fi, err := os.Stat(file)
+		if err != nil || !fi.ModTime().Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
+
+// getConfig is the GetConfigForClient of the listener. It checks for changed
+// files at most once a second; if they no longer load the previous config is
+// kept.
+func (w *webTLS) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.checked) < time.Second {
+		return w.config, nil
+	}
+	w.checked = now
+	if !w.changed() {
+		return w.config, nil
+	}
+
+	config, mtimes, err := w.load()
+	if err == nil && config == nil {
+		err = fmt.Errorf("tls_server_config was removed, TLS can only be disabled by a restart")
+	}
+	if err != nil {
+		fmt.Printf("Error: reloading web config, keeping the previous TLS config: %s\n", err)
+		// only retry once the files change again
+		for file := range w.mtimes {
+			if fi, err := os.Stat(file); err == nil {
+				w.mtimes[file] = fi.ModTime()
+			}
+		}
+		return w.config, nil
+	}
+	fmt.Println("Web config reloaded..")
+	w.config, w.mtimes = config, mtimes
+	return w.config, nil
+}
+
+// TLSConfig is the config to listen with.
+func (w *webTLS) TLSConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: w.getConfig, NextProtos: webNextProtos}
+}
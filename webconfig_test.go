@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+// writeWebConfig writes a web config file with a self-signed certificate for
+// 127.0.0.1 to dir.
+func writeWebConfig(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "prom2click"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"cert.pem": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		"web.yml": []byte("tls_server_config:\n  cert_file: " + filepath.Join(dir, "cert.pem") +
+			"\n  key_file: " + filepath.Join(dir, "key.pem") + "\n"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "web.yml")
+}
+
+// Clients negotiating HTTP/2 over TLS are served, not disconnected.
+func TestWebTLSServesHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wt, err := newWebTLS(writeWebConfig(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(r.Proto)) })
+	// what ListenAndServeTLSConfig does, on a free port
+	srv := &graceful.Server{Timeout: time.Second, Server: &http.Server{Handler: mux, TLSConfig: wt.TLSConfig()}}
+	go srv.Serve(tls.NewListener(l, srv.TLSConfig))
+	defer srv.Stop(0)
+
+	for _, test := range []struct {
+		http2 bool
+		proto string
+	}{{false, "HTTP/1.1"}, {true, "HTTP/2.0"}} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: test.http2,
+		}}
+		resp, err := client.Get("https://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Errorf("http2 %v: %s", test.http2, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != test.proto {
+			t.Errorf("http2 %v: served over %s, want %s", test.http2, body, test.proto)
+		}
+	}
+}
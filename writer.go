@@ -3,38 +3,77 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"github.com/kshvakov/clickhouse"
+	"github.com/ClickHouse/clickhouse-go"
 	"sync"
+	"sync/atomic"
 	"github.com/prometheus/client_golang/prometheus"
+	cfg "github.com/prom2click/config"
+	"github.com/prom2click/database"
+	"github.com/prom2click/job"
 	pro "github.com/prom2click/protocal"
+	"github.com/prom2click/schema"
 )
 
 var insertSQL = `INSERT INTO %s.%s
-	(ip,app,name,job,namespace,shard,keyspace,component,containername, val, ts,date,tags)
-	VALUES	(?, ?, ?, ?, ?, ?,?,?,?,?,?,?,?)`
+	(ip,app,name,job,namespace,shard,keyspace,component,containername, val, ts,date,tags,stale)
+	VALUES	(?, ?, ?, ?, ?, ?,?,?,?,?,?,?,?,?)`
+
+// insertTenantSQL is insertSQL with the tenant column, used when tenants are enabled
+var insertTenantSQL = `INSERT INTO %s.%s
+	(ip,app,name,job,namespace,shard,keyspace,component,containername, val, ts,date,tags,stale,tenant)
+	VALUES	(?, ?, ?, ?, ?, ?,?,?,?,?,?,?,?,?,?)`
 
 type p2cWriter struct {
-	conf     *config
-	requests chan *pro.K8sRequest
-	wg       sync.WaitGroup
-	db       *sql.DB
-	table    string
-	tx       prometheus.Counter
-	ko       prometheus.Counter
-	test     prometheus.Counter
-	timings  prometheus.Histogram
+	conf        *config
+	job         string
+	jm          *job.JobManager
+	requests    <-chan *pro.K8sRequest
+	quit        chan struct{}
+	stopOnce    sync.Once
+	unsubscribe func()
+	wg          sync.WaitGroup
+	db          *database.Pool
+	table       atomic.Value // string
+	series      *seriesCache // only set for the split layout
+	tx          prometheus.Counter
+	ko          prometheus.Counter
+	test        prometheus.Counter
+	timings     prometheus.Histogram
+}
+
+func NewP2CWriter(conf *config, jobname string, jm *job.JobManager) (*p2cWriter, error) {
+	requests, ok := jm.Channel(jobname)
+	if !ok {
+		return nil, fmt.Errorf("job not found")
+	}
+	table, ok := jm.Snapshot().Table(jobname)
+	if !ok {
+		return nil, fmt.Errorf("no table configured")
+	}
+
+	w, err := newP2CWriter(conf, jobname, table, requests)
+	if err != nil {
+		return w, err
+	}
+	w.jm = jm
+	return w, nil
 }
 
-func NewP2CWriter(conf *config, job string, table string, reqs chan *pro.K8sRequest) (*p2cWriter, error) {
+// newP2CWriter creates a writer for a fixed table that does not follow the
+// job config, eg. the fallback table for unrouted series.
+func newP2CWriter(conf *config, name string, table string, requests <-chan *pro.K8sRequest) (*p2cWriter, error) {
 	var err error
 	w := new(p2cWriter)
 	w.conf = conf
-	w.requests = reqs
-	w.table = table
-	w.db, err = sql.Open("clickhouse", w.conf.ChDSN)
-	w.db.SetMaxOpenConns(20)
-	w.db.SetMaxIdleConns(2)
-	w.db.Ping()
+	w.job = name
+	w.requests = requests
+	w.quit = make(chan struct{})
+	w.table.Store(table)
+	if schema.Layout(conf.ChLayout) == schema.LayoutSplit {
+		w.series = newSeriesCache(conf.ChSeriesCache)
+	}
+
+	w.db, err = database.Open(w.conf.dsn, 20, 2)
 	if err != nil {
 		fmt.Printf("Error connecting to clickhouse: %s\n", err.Error())
 		return w, err
@@ -43,70 +82,141 @@ func NewP2CWriter(conf *config, job string, table string, reqs chan *pro.K8sRequ
 	return w, nil
 }
 
+// update follows config reloads: the writer switches table if its job was
+// re-pointed and stops if the job was removed.
+func (w *p2cWriter) update(snap *cfg.Snapshot) {
+	table, ok := snap.Table(w.job)
+	if !ok {
+		w.Stop()
+		return
+	}
+	w.table.Store(table)
+}
+
+func (w *p2cWriter) Table() string {
+	return w.table.Load().(string)
+}
+
 func (w *p2cWriter) Start() {
 
+	w.unsubscribe = func() {}
+	if w.jm != nil {
+		w.unsubscribe = w.jm.Subscribe(w.update)
+	}
+	w.wg.Add(1)
 	go func() {
-		fmt.Println("Writer starting..")
-		sql := fmt.Sprintf(insertSQL, w.conf.ChDB, w.table)
-		ok := true
-		for {
+		defer w.wg.Done()
+		defer w.unsubscribe()
+		// a stopped writer is never restarted, a re-added job gets a new one
+		defer w.db.Close()
+		fmt.Printf("Writer for job %s starting..\n", w.job)
+		running := true
+		for running {
 			// get next batch of requests
 			var reqs []*pro.K8sRequest
 
-			//tstart := time.Now()
-			for i := 0; i < w.conf.ChBatch; i++ {
-				var req *pro.K8sRequest
-				// get requet and also check if channel is closed
-				req, ok = <-w.requests
-				if !ok {
-					fmt.Println("Writer stopping..")
-					break
+			for len(reqs) < w.conf.ChBatch && running {
+				select {
+				case req := <-w.requests:
+					reqs = append(reqs, req)
+				case <-w.quit:
+					// the job manager no longer routes to us, flush what is left
+					reqs = w.drain(reqs)
+					running = false
 				}
-				reqs = append(reqs, req)
 			}
 
-			// ensure we have something to send..
-			nmetrics := len(reqs)
-			if nmetrics < 1 {
-				continue
-			}
+			w.write(reqs)
+		}
+		fmt.Printf("Writer for job %s stopped..\n", w.job)
+	}()
+}
 
-			// post them to db all at once
-			tx, err := w.db.Begin()
-			if err != nil {
-				fmt.Printf("Error: begin transaction: %s\n", err.Error())
-				continue
-			}
+// drain appends every request still buffered in the channel without blocking.
+func (w *p2cWriter) drain(reqs []*pro.K8sRequest) []*pro.K8sRequest {
+	for {
+		select {
+		case req := <-w.requests:
+			reqs = append(reqs, req)
+		default:
+			return reqs
+		}
+	}
+}
 
-			// build statements
-			smt, err := tx.Prepare(sql)
-			if err != nil {
-				fmt.Printf("Error: prepare statement: %s\n", err.Error())
-			}
-			for _, req := range reqs {
-				if err != nil {
-					fmt.Printf("Error: prepare statement: %s\n", err.Error())
-					continue
-				}
-				_, err = smt.Exec(req.Ip, req.App, req.Name, req.Job, req.Namespace, req.Shard, req.Keyspace, req.Component, req.Containername,
-					req.Val, req.Ts, req.Ts, clickhouse.Array(req.Tags))
+func (w *p2cWriter) write(reqs []*pro.K8sRequest) {
+	// ensure we have something to send..
+	nmetrics := len(reqs)
+	if nmetrics < 1 {
+		return
+	}
 
-				if err != nil {
-					fmt.Printf("Error: statement exec: %s\n", err.Error())
-				}
-			}
+	if w.series != nil {
+		w.writeSplit(reqs)
+		return
+	}
+
+	if w.conf.spec.Tenants {
+		w.insert(fmt.Sprintf(insertTenantSQL, w.conf.ChDB, w.Table()), nmetrics, func(smt *sql.Stmt, i int) error {
+			req := reqs[i]
+			_, err := smt.Exec(req.Ip, req.App, req.Name, req.Job, req.Namespace, req.Shard, req.Keyspace, req.Component, req.Containername,
+				req.Val, req.Ts, req.Ts, clickhouse.Array(req.Tags), req.Stale, req.Tenant)
+			return err
+		})
+		return
+	}
 
-			// commit and record metrics
-			if err = tx.Commit(); err != nil {
-				fmt.Printf("Error: commit failed: %s\n", err.Error())
-			} else {
+	w.insert(fmt.Sprintf(insertSQL, w.conf.ChDB, w.Table()), nmetrics, func(smt *sql.Stmt, i int) error {
+		req := reqs[i]
+		_, err := smt.Exec(req.Ip, req.App, req.Name, req.Job, req.Namespace, req.Shard, req.Keyspace, req.Component, req.Containername,
+			req.Val, req.Ts, req.Ts, clickhouse.Array(req.Tags), req.Stale)
+		return err
+	})
+}
 
+// insert executes the prepared query n times in a single batch, exec is called
+// with the index of each row. Rows that fail are left out of the batch, the
+// first error is returned so the caller knows not everything was written.
+func (w *p2cWriter) insert(query string, n int, exec func(smt *sql.Stmt, i int) error) error {
+	// post them to db all at once
+	tx, err := w.db.DB().Begin()
+	if err != nil {
+		fmt.Printf("Error: begin transaction: %s\n", err.Error())
+		return err
+	}
+
+	// build statements
+	smt, err := tx.Prepare(query)
+	if err != nil {
+		fmt.Printf("Error: prepare statement: %s\n", err.Error())
+		tx.Rollback()
+		return err
+	}
+	//MUST close fd here ! it is must must must or we will encounter too many open files error !
+	defer smt.Close()
+
+	var execErr error
+	for i := 0; i < n; i++ {
+		if err = exec(smt, i); err != nil {
+			fmt.Printf("Error: statement exec: %s\n", err.Error())
+			if execErr == nil {
+				execErr = err
 			}
-			//MUST close fd here ! it is must must must or we will encounter too many open files error !
-			smt.Close()
 		}
-		fmt.Println("Writer stopped..")
-	}()
+	}
+
+	// commit and record metrics
+	if err = tx.Commit(); err != nil {
+		fmt.Printf("Error: commit failed: %s\n", err.Error())
+		return err
+	}
+	return execErr
+}
+
+// Stop makes the writer flush what is buffered and exit, it is safe to call
+// more than once.
+func (w *p2cWriter) Stop() {
+	w.stopOnce.Do(func() { close(w.quit) })
 }
 
 func (w *p2cWriter) Wait() {